@@ -29,30 +29,59 @@ func (acc *Account) Init() {
 	}
 }
 
+func (acc Account) TypeName() string {
+	return "Account"
+}
+
 func (acc Account) Save() error {
+	return WithTx(acc.SaveWith)
+}
+
+func (acc Account) SaveWith(q Querier) error {
 	if len(acc.Id) <= 0 {
 		return errors.New("All accounts must have a non empty id")
 	}
 	if len(acc.Name) <= 0 {
 		return errors.New("All accounts must have a non empty name")
 	}
-	_, err := DB.Exec("INSERT INTO `Account` (`Id`, `ParentId`, `Name`, `Desc`) VALUES (?, ?, ?, ?)", acc.Id, acc.ParentId, acc.Name, acc.Desc)
-	return err
+	_, err := q.Exec("INSERT INTO `Account` (`Id`, `ParentId`, `Name`, `Desc`) VALUES (?, ?, ?, ?)", acc.Id, acc.ParentId, acc.Name, acc.Desc)
+	if err != nil {
+		return err
+	}
+	return save_tags(q, acc.TypeName(), acc.Id, acc.Tags)
 }
 
 func (acc Account) Update() error {
-	_, err := DB.Exec("UPDATE `Account` SET `ParentId` = ?, `Name` = ?, `Desc` = ? WHERE `Id` = ?", acc.ParentId, acc.Name, acc.Desc, acc.Id)
-	return err
+	return WithTx(acc.UpdateWith)
+}
+
+func (acc Account) UpdateWith(q Querier) error {
+	_, err := q.Exec("UPDATE `Account` SET `ParentId` = ?, `Name` = ?, `Desc` = ? WHERE `Id` = ?", acc.ParentId, acc.Name, acc.Desc, acc.Id)
+	if err != nil {
+		return err
+	}
+	return save_tags(q, acc.TypeName(), acc.Id, acc.Tags)
 }
 
 func (acc Account) Del(id string) error {
-	_, err := DB.Exec("DELETE FROM `Account` WHERE `Id` = ?", id)
-	return err
+	return acc.DelWith(DB, id)
+}
+
+func (acc Account) DelWith(q Querier, id string) error {
+	_, err := q.Exec("DELETE FROM `Account` WHERE `Id` = ?", id)
+	if err != nil {
+		return err
+	}
+	return del_tags(q, acc.TypeName(), id)
 }
 
 func (acc *Account) Load(id string) error {
 	err := DB.QueryRow("SELECT `Id`, `ParentId`, `Name`, `Desc` FROM `Account` WHERE `Id` = ?", id).
 		Scan(&acc.Id, &acc.ParentId, &acc.Name, &acc.Desc)
+	if err != nil {
+		return err
+	}
+	acc.Tags, err = load_tags(DB, acc.TypeName(), acc.Id)
 	return err
 }
 
@@ -62,10 +91,16 @@ func (acc Account) MultilineString() string {
 	s += fmt.Sprintf("%s %s\n", Bold("ParentId:"), acc.ParentId)
 	s += fmt.Sprintf("%s %s\n", Bold("    Name:"), acc.Name)
 	s += fmt.Sprintf("%s %s\n", Bold("    Desc:"), acc.Desc)
+	s += fmt.Sprintf("%s %s\n", Bold("    Tags:"), tags_string(acc.Tags))
 	return s
 }
 
 func account_show(line []string) {
+	line, expr, err := parse_tag_filter(line)
+	if err != nil {
+		print_err(Red(err.Error()))
+		return
+	}
 	spec := ""
 	if len(line) > 0 {
 		spec = line[0]
@@ -83,9 +118,13 @@ func account_show(line []string) {
 		if err != nil {
 			log.Fatal(err)
 		}
+		if expr != nil && !expr(effective_tags(acc.TypeName(), acc.Id, "")) {
+			continue
+		}
 		accs = append(accs, acc)
 	}
 	if len(accs) == 1 {
+		accs[0].Load(accs[0].Id)
 		fmt.Printf(accs[0].MultilineString())
 		return
 	}
@@ -150,21 +189,22 @@ func account_add(line []string) {
 		"",
 		nil,
 		True)
+	acc.Tags = ask_tags(Sprintf(Bold("    Tags: ")), acc.Tags)
 	err := acc.Save()
 	if err != nil {
-		fmt.Println(err.Error())
+		print_err(err.Error())
 	}
 }
 
 func account_edit(line []string) {
 	if len(line) == 0 {
-		fmt.Println(Red("No id specified"))
+		print_err(Red("No id specified"))
 		return
 	}
 	acc := Account{}
 	err := acc.Load(line[len(line)-1])
 	if err != nil {
-		fmt.Println(err.Error())
+		print_err(err.Error())
 		return
 	}
 
@@ -187,15 +227,16 @@ func account_edit(line []string) {
 		acc.Desc,
 		nil,
 		True)
+	acc.Tags = ask_tags(Sprintf(Bold("    Tags: ")), acc.Tags)
 	err = acc.Update()
 	if err != nil {
-		fmt.Println(err.Error())
+		print_err(err.Error())
 	}
 }
 
 func account_del(line []string) {
 	if len(line) == 0 {
-		fmt.Println(Red("No id specified"))
+		print_err(Red("No id specified"))
 		return
 	}
 	id := line[len(line)-1]
@@ -36,30 +36,59 @@ func (ak AssetKind) ANSIString() string {
 	return fmt.Sprintf("%-10.10s %8s %s", Bold(ak.Id), places, ak.Name)
 }
 
+func (ak AssetKind) TypeName() string {
+	return "AssetKind"
+}
+
 func (ak AssetKind) Save() error {
+	return WithTx(ak.SaveWith)
+}
+
+func (ak AssetKind) SaveWith(q Querier) error {
 	if len(ak.Id) <= 0 {
 		return errors.New("All asset kinds must have a non empty id")
 	}
 	if len(ak.Name) <= 0 {
 		return errors.New("All asset kinds must have a non empty name")
 	}
-	_, err := DB.Exec("INSERT INTO `AssetKind` (`Id`, `Name`, `Desc`, `DecimalPlaces`) VALUES (?, ?, ?, ?)", ak.Id, ak.Name, ak.Desc, ak.DecimalPlaces)
-	return err
+	_, err := q.Exec("INSERT INTO `AssetKind` (`Id`, `Name`, `Desc`, `DecimalPlaces`) VALUES (?, ?, ?, ?)", ak.Id, ak.Name, ak.Desc, ak.DecimalPlaces)
+	if err != nil {
+		return err
+	}
+	return save_tags(q, ak.TypeName(), ak.Id, ak.Tags)
 }
 
 func (ak AssetKind) Update() error {
-	_, err := DB.Exec("UPDATE `AssetKind` SET `Name` = ?, `Desc` = ?, `DecimalPlaces` = ? WHERE `Id` = ?", ak.Name, ak.Desc, ak.DecimalPlaces, ak.Id)
-	return err
+	return WithTx(ak.UpdateWith)
+}
+
+func (ak AssetKind) UpdateWith(q Querier) error {
+	_, err := q.Exec("UPDATE `AssetKind` SET `Name` = ?, `Desc` = ?, `DecimalPlaces` = ? WHERE `Id` = ?", ak.Name, ak.Desc, ak.DecimalPlaces, ak.Id)
+	if err != nil {
+		return err
+	}
+	return save_tags(q, ak.TypeName(), ak.Id, ak.Tags)
 }
 
 func (ak AssetKind) Del(id string) error {
-	_, err := DB.Exec("DELETE FROM `AssetKind` WHERE `Id` = ?", id)
-	return err
+	return ak.DelWith(DB, id)
+}
+
+func (ak AssetKind) DelWith(q Querier, id string) error {
+	_, err := q.Exec("DELETE FROM `AssetKind` WHERE `Id` = ?", id)
+	if err != nil {
+		return err
+	}
+	return del_tags(q, ak.TypeName(), id)
 }
 
 func (ak *AssetKind) Load(id string) error {
 	err := DB.QueryRow("SELECT `Id`, `Name`, `Desc`, `DecimalPlaces` FROM `AssetKind` WHERE `Id` = ?", id).
 		Scan(&ak.Id, &ak.Name, &ak.Desc, &ak.DecimalPlaces)
+	if err != nil {
+		return err
+	}
+	ak.Tags, err = load_tags(DB, ak.TypeName(), ak.Id)
 	return err
 }
 
@@ -69,6 +98,7 @@ func (ak AssetKind) MultilineString() string {
 	s += fmt.Sprintf("%s %s\n", Bold("          Name:"), ak.Name)
 	s += fmt.Sprintf("%s %s\n", Bold("          Desc:"), ak.Desc)
 	s += fmt.Sprintf("%s %d\n", Bold("Decimal places:"), ak.DecimalPlaces)
+	s += fmt.Sprintf("%s %s\n", Bold("          Tags:"), tags_string(ak.Tags))
 	return s
 }
 
@@ -135,33 +165,37 @@ func full_decimal_fmt_pad(val_raw int, pad int, asset_kind_id string) (string, e
 }
 
 func fmt_decimal(raw, decimal_places int) string {
-	div := int(math.Pow10(decimal_places))
-	quotient := raw / div
-	remainder := raw - div*quotient
-	if remainder < 0 {
-		remainder *= -1
-	}
-	return fmt.Sprintf("%d.%0.*d", quotient, decimal_places, remainder)
+	return fmt_decimal_pad(raw, decimal_places, 0)
 }
 
 func fmt_decimal_pad(raw, decimal_places, pad int) string {
-	div := int(math.Pow10(decimal_places))
-	quotient := raw / div
-	remainder := raw - div*quotient
-	if remainder < 0 {
-		remainder *= -1
+	sign := ""
+	if raw < 0 {
+		// Otherwise values between -1 and 0 would lose their sign
+		sign = "-"
+		raw = -raw
 	}
-	return fmt.Sprintf("%*d.%0.*d", pad, quotient, decimal_places, remainder)
+	// The padding applies to the integer part only so that dots line up
+	if decimal_places <= 0 {
+		return fmt.Sprintf("%*s", pad, fmt.Sprintf("%s%d", sign, raw))
+	}
+	div := int(math.Pow10(decimal_places))
+	return fmt.Sprintf("%*s.%0*d", pad, fmt.Sprintf("%s%d", sign, raw/div), decimal_places, raw%div)
 }
 
 func asset_kind_show(line []string) {
+	line, expr, err := parse_tag_filter(line)
+	if err != nil {
+		print_err(Red(err.Error()))
+		return
+	}
 	spec := ""
 	if len(line) > 0 {
 		spec = line[0]
 	}
 
 	ak := NewAssetKind()
-	err := ak.Load(spec)
+	err = ak.Load(spec)
 	if err == nil {
 		fmt.Printf(ak.MultilineString())
 		return
@@ -179,6 +213,9 @@ func asset_kind_show(line []string) {
 		if err != nil {
 			log.Fatal(err)
 		}
+		if expr != nil && !expr(effective_tags(ak.TypeName(), ak.Id, "")) {
+			continue
+		}
 		fmt.Printf("%s\n", ak.ANSIString())
 	}
 }
@@ -210,22 +247,23 @@ func asset_kind_add(line []string) {
 		"",
 		nil,
 		IsInt), 0)
+	ak.Tags = ask_tags(Sprintf(Bold("Tags: ")), ak.Tags)
 
 	err := ak.Save()
 	if err != nil {
-		fmt.Println(err.Error())
+		print_err(err.Error())
 	}
 }
 
 func asset_kind_edit(line []string) {
 	if len(line) == 0 {
-		fmt.Println(Red("No id specified"))
+		print_err(Red("No id specified"))
 		return
 	}
 	ak := AssetKind{}
 	err := ak.Load(line[len(line)-1])
 	if err != nil {
-		fmt.Println(err.Error())
+		print_err(err.Error())
 		return
 	}
 
@@ -248,16 +286,17 @@ func asset_kind_edit(line []string) {
 		Sprintf(ak.DecimalPlaces),
 		nil,
 		IsInt), 0)
+	ak.Tags = ask_tags(Sprintf(Bold("Tags: ")), ak.Tags)
 
 	err = ak.Update()
 	if err != nil {
-		fmt.Println(err.Error())
+		print_err(err.Error())
 	}
 }
 
 func asset_kind_del(line []string) {
 	if len(line) == 0 {
-		fmt.Println(Red("No id specified"))
+		print_err(Red("No id specified"))
 		return
 	}
 	id := line[len(line)-1]
@@ -17,6 +17,7 @@ type AssetValue struct {
 	Value   int // Value of AssetId in terms of RefId
 	Date    time.Time
 	Notes   string
+	Tags    map[string]bool
 }
 
 func NewAssetValue() *AssetValue {
@@ -26,6 +27,9 @@ func NewAssetValue() *AssetValue {
 }
 
 func (av *AssetValue) Init() {
+	if av.Tags == nil {
+		av.Tags = make(map[string]bool)
+	}
 }
 
 func (av AssetValue) ANSIString() string {
@@ -45,6 +49,10 @@ func (av *AssetValue) GenId() {
 }
 
 func (av *AssetValue) Save() error {
+	return WithTx(av.SaveWith)
+}
+
+func (av *AssetValue) SaveWith(q Querier) error {
 	if len(av.Id) <= 0 {
 		av.GenId()
 	}
@@ -54,18 +62,35 @@ func (av *AssetValue) Save() error {
 	if len(av.RefId) <= 0 {
 		return errors.New("All asset values must have a non empty RefId")
 	}
-	_, err := DB.Exec("INSERT INTO `AssetValue` (`Id`, `AssetId`, `RefId`, `Value`, `Date`, `Notes`) VALUES (?, ?, ?, ?, ?, ?)", av.Id, av.AssetId, av.RefId, av.Value, av.Date.Unix(), av.Notes)
-	return err
+	_, err := q.Exec("INSERT INTO `AssetValue` (`Id`, `AssetId`, `RefId`, `Value`, `Date`, `Notes`) VALUES (?, ?, ?, ?, ?, ?)", av.Id, av.AssetId, av.RefId, av.Value, av.Date.Unix(), av.Notes)
+	if err != nil {
+		return err
+	}
+	return save_tags(q, av.TypeName(), av.Id, av.Tags)
 }
 
 func (av AssetValue) Update() error {
-	_, err := DB.Exec("UPDATE `AssetValue` SET `Value` = ?, `Notes` = ? WHERE `Id` = ?", av.Value, av.Notes, av.Id)
-	return err
+	return WithTx(av.UpdateWith)
+}
+
+func (av AssetValue) UpdateWith(q Querier) error {
+	_, err := q.Exec("UPDATE `AssetValue` SET `Value` = ?, `Notes` = ? WHERE `Id` = ?", av.Value, av.Notes, av.Id)
+	if err != nil {
+		return err
+	}
+	return save_tags(q, av.TypeName(), av.Id, av.Tags)
 }
 
 func (av AssetValue) Del(id string) error {
-	_, err := DB.Exec("DELETE FROM `AssetValue` WHERE `Id` = ?", id)
-	return err
+	return av.DelWith(DB, id)
+}
+
+func (av AssetValue) DelWith(q Querier, id string) error {
+	_, err := q.Exec("DELETE FROM `AssetValue` WHERE `Id` = ?", id)
+	if err != nil {
+		return err
+	}
+	return del_tags(q, av.TypeName(), id)
 }
 
 func (av *AssetValue) Load(id string) error {
@@ -73,6 +98,10 @@ func (av *AssetValue) Load(id string) error {
 	err := DB.QueryRow("SELECT `Id`, `AssetId`, `RefId`, `Value`, `Date`, `Notes` FROM `AssetValue` WHERE `Id` = ?", id).
 		Scan(&av.Id, &av.AssetId, &av.RefId, &av.Value, &tmp, &av.Notes)
 	av.Date = time.Unix(tmp, 0)
+	if err != nil {
+		return err
+	}
+	av.Tags, err = load_tags(DB, av.TypeName(), av.Id)
 	return err
 }
 
@@ -107,23 +136,29 @@ func (av AssetValue) MultilineString() string {
 	s += fmt.Sprintf("%s %s\n", Bold("  Value:"), val_str)
 	s += fmt.Sprintf("%s %s\n", Bold("   Date:"), av.Date.Format(DATE_FMT_SPACES))
 	s += fmt.Sprintf("%s %s\n", Bold("  Notes:"), av.Notes)
+	s += fmt.Sprintf("%s %s\n", Bold("   Tags:"), tags_string(av.Tags))
 	return s
 }
 
 func asset_value_show(line []string) {
+	line, expr, err := parse_tag_filter(line)
+	if err != nil {
+		print_err(Red(err.Error()))
+		return
+	}
 	spec := ""
 	if len(line) > 0 {
 		spec = line[0]
 	}
 
 	av := NewAssetValue()
-	err := av.Load(spec)
+	err = av.Load(spec)
 	if err == nil {
 		fmt.Printf(av.MultilineString())
 		return
 	}
 
-	rows, err := DB.Query("SELECT `Id` FROM `AssetValue` WHERE `Id` LIKE '%%"+spec+"%%' OR `AssetId` = ? OR ? = '' LIMIT 64", spec, spec, spec)
+	rows, err := DB.Query("SELECT `Id` FROM `AssetValue` WHERE `Id` LIKE '%%"+spec+"%%' OR `AssetId` = ? OR ? = ''"+show_limit(expr), spec, spec, spec)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -140,6 +175,9 @@ func asset_value_show(line []string) {
 		if err != nil {
 			log.Fatal(err)
 		}
+		if expr != nil && !expr(av.Tags) {
+			continue
+		}
 		fmt.Println(av.ANSIString())
 	}
 }
@@ -178,29 +216,30 @@ func asset_value_add(line []string) {
 		"",
 		nil,
 		True)
+	av.Tags = ask_tags(Sprintf(Bold("   Tags: ")), av.Tags)
 	// Parse stuff
 	av.StrToValue(val_str)
 	av.Date, err = time.Parse(DAY_FMT, date_str)
 	if err != nil {
-		fmt.Println(err.Error())
+		print_err(err.Error())
 		return
 	}
 	// Save
 	err = av.Save()
 	if err != nil {
-		fmt.Println(err.Error())
+		print_err(err.Error())
 	}
 }
 
 func asset_value_edit(line []string) {
 	if len(line) == 0 {
-		fmt.Println(Red("No id specified"))
+		print_err(Red("No id specified"))
 		return
 	}
 	av := AssetValue{}
 	err := av.Load(line[len(line)-1])
 	if err != nil {
-		fmt.Println(err.Error())
+		print_err(err.Error())
 		return
 	}
 
@@ -221,17 +260,18 @@ func asset_value_edit(line []string) {
 		"",
 		nil,
 		True)
+	av.Tags = ask_tags(Sprintf(Bold("   Tags: ")), av.Tags)
 
 	av.StrToValue(val_str)
 	err = av.Update()
 	if err != nil {
-		fmt.Println(err.Error())
+		print_err(err.Error())
 	}
 }
 
 func asset_value_del(line []string) {
 	if len(line) == 0 {
-		fmt.Println(Red("No id specified"))
+		print_err(Red("No id specified"))
 		return
 	}
 	id := line[len(line)-1]
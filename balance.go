@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/logrusorgru/aurora"
+)
+
+// Balance maps an AssetKindId to a raw (integer) amount of that asset.
+type Balance map[string]int
+
+func (bal Balance) Add(other Balance) {
+	for asset_id, val := range other {
+		bal[asset_id] += val
+	}
+}
+
+func (bal Balance) AssetIds() []string {
+	ids := make([]string, 0, len(bal))
+	for asset_id := range bal {
+		ids = append(ids, asset_id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (bal Balance) ANSIString(kinds map[string]AssetKind) string {
+	parts := make([]string, 0)
+	for _, asset_id := range bal.AssetIds() {
+		val := bal[asset_id]
+		num := fmt.Sprintf("%d", val)
+		if ak, ok := kinds[asset_id]; ok {
+			num = fmt_decimal(val, ak.DecimalPlaces)
+		}
+		if val >= 0 {
+			num = Sprintf(Cyan(num))
+		} else {
+			num = Sprintf(Red(num))
+		}
+		parts = append(parts, fmt.Sprintf("%s %s", num, Bold(asset_id)))
+	}
+	if len(parts) == 0 {
+		return Sprintf(Gray("0"))
+	}
+	return strings.Join(parts, " ")
+}
+
+func load_asset_kinds() map[string]AssetKind {
+	rows, err := DB.Query("SELECT `Id`, `Name`, `Desc`, `DecimalPlaces` FROM `AssetKind`")
+	if err != nil {
+		log.Fatal(err)
+	}
+	kinds := make(map[string]AssetKind)
+	defer rows.Close()
+	for rows.Next() {
+		ak := AssetKind{}
+		err := rows.Scan(&ak.Id, &ak.Name, &ak.Desc, &ak.DecimalPlaces)
+		if err != nil {
+			log.Fatal(err)
+		}
+		kinds[ak.Id] = ak
+	}
+	return kinds
+}
+
+func load_accounts() []Account {
+	rows, err := DB.Query("SELECT `Id`, `ParentId`, `Name`, `Desc` FROM `Account`")
+	if err != nil {
+		log.Fatal(err)
+	}
+	accs := make([]Account, 0)
+	defer rows.Close()
+	for rows.Next() {
+		acc := Account{}
+		err := rows.Scan(&acc.Id, &acc.ParentId, &acc.Name, &acc.Desc)
+		if err != nil {
+			log.Fatal(err)
+		}
+		accs = append(accs, acc)
+	}
+	return accs
+}
+
+// Selects which transaction parts are taken into account when computing balances
+type BalanceFilter struct {
+	Until    time.Time // Zero means no cutoff
+	Statuses map[string]bool
+}
+
+// Parts already finished
+func ClearedFilter(until time.Time) BalanceFilter {
+	return BalanceFilter{Until: until, Statuses: map[string]bool{TS_FINISHED: true}}
+}
+
+// Parts finished, on going or already scheduled
+func ScheduledFilter(until time.Time) BalanceFilter {
+	return BalanceFilter{Until: until, Statuses: map[string]bool{TS_FINISHED: true, TS_ON_GOING: true, TS_SCHEDULED: true}}
+}
+
+// Everything that was not canceled, including planned parts
+func ProjectedFilter(until time.Time) BalanceFilter {
+	return BalanceFilter{Until: until, Statuses: map[string]bool{TS_UNSET: true, TS_FINISHED: true, TS_ON_GOING: true, TS_SCHEDULED: true, TS_PLANNED: true}}
+}
+
+func (filter BalanceFilter) Accepts(tp TransactionPart) bool {
+	if tp.Status == TS_CANCELED || !filter.Statuses[tp.Status] {
+		return false
+	}
+	if filter.Until.IsZero() {
+		return true
+	}
+	return !tp.EffectiveDate().After(filter.Until)
+}
+
+// Returns the balance of every account considering only its own parts (i.e. children are not included)
+func load_direct_balances(filter BalanceFilter) map[string]Balance {
+	// Same semantics as TransactionPart.Date()
+	query := "SELECT `AccountId`, `AssetKindId`, `Status`, SUM(`Value`) FROM `TransactionPart` WHERE `Status` != ? AND (? = 0 OR (CASE WHEN `Status` = ? THEN `ActualDate` ELSE `ScheduledFor` END) <= ?) GROUP BY `AccountId`, `AssetKindId`, `Status`"
+	until := int64(0)
+	if !filter.Until.IsZero() {
+		until = filter.Until.Unix()
+	}
+	rows, err := DB.Query(query, TS_CANCELED, until, TS_FINISHED, until)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ans := make(map[string]Balance)
+	defer rows.Close()
+	for rows.Next() {
+		var acc_id, asset_id, status string
+		var val int
+		err := rows.Scan(&acc_id, &asset_id, &status, &val)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !filter.Statuses[status] {
+			continue
+		}
+		if ans[acc_id] == nil {
+			ans[acc_id] = make(Balance)
+		}
+		ans[acc_id][asset_id] += val
+	}
+	return ans
+}
+
+// Returns the account and all its descendants
+func account_subtree(accs []Account, acc_id string) map[string]bool {
+	ans := map[string]bool{acc_id: true}
+	for changed := true; changed; {
+		changed = false
+		for _, acc := range accs {
+			if ans[acc.ParentId] && !ans[acc.Id] {
+				ans[acc.Id] = true
+				changed = true
+			}
+		}
+	}
+	return ans
+}
+
+// Sums the direct balances of each account with the ones of all its descendants
+func rollup_balances(accs []Account, direct map[string]Balance) map[string]Balance {
+	ans := make(map[string]Balance)
+	visiting := make(map[string]bool)
+	var subtotal func(acc_id string) Balance
+	subtotal = func(acc_id string) Balance {
+		if bal, ok := ans[acc_id]; ok {
+			return bal
+		}
+		bal := make(Balance)
+		// Avoid infinite loops on broken account trees
+		if visiting[acc_id] {
+			return bal
+		}
+		visiting[acc_id] = true
+		bal.Add(direct[acc_id])
+		for _, acc := range accs {
+			if acc.ParentId == acc_id && acc.Id != acc_id {
+				bal.Add(subtotal(acc.Id))
+			}
+		}
+		ans[acc_id] = bal
+		return bal
+	}
+	for _, acc := range accs {
+		subtotal(acc.Id)
+	}
+	return ans
+}
+
+// Usage: account balance [account] [date] [cleared|scheduled|projected]
+// When no balance kind is given, all three are shown side by side.
+func account_balance(line []string) {
+	acc_id := ""
+	until := time.Time{}
+	labels := []string{"cleared", "scheduled", "projected"}
+	for _, arg := range line {
+		switch {
+		case arg == "cleared" || arg == "scheduled" || arg == "projected":
+			labels = []string{arg}
+		case IsDay(arg):
+			date, _ := time.Parse(DAY_FMT, arg)
+			until = EndOfDay(date)
+		default:
+			acc_id = arg
+		}
+	}
+
+	accs := load_accounts()
+	kinds := load_asset_kinds()
+	totals := make([]map[string]Balance, 0)
+	for _, label := range labels {
+		filter := ProjectedFilter(until)
+		switch label {
+		case "cleared":
+			filter = ClearedFilter(until)
+		case "scheduled":
+			filter = ScheduledFilter(until)
+		}
+		totals = append(totals, rollup_balances(accs, load_direct_balances(filter)))
+	}
+	fmt_balance := func(acc_id string) string {
+		if len(totals) == 1 {
+			return totals[0][acc_id].ANSIString(kinds)
+		}
+		parts := make([]string, 0)
+		for i, label := range labels {
+			parts = append(parts, fmt.Sprintf("%s %s", Gray(label+":"), totals[i][acc_id].ANSIString(kinds)))
+		}
+		return strings.Join(parts, " ┃ ")
+	}
+
+	printed := make(map[string]bool)
+	if acc_id == "" {
+		account_balance_print_children(-1, Account{}, printed, accs, fmt_balance)
+		return
+	}
+	acc := Account{}
+	err := acc.Load(acc_id)
+	if err != nil {
+		print_err(err.Error())
+		return
+	}
+	account_balance_print_children(0, acc, printed, accs, fmt_balance)
+}
+
+func account_balance_print_children(level int, parent Account, printed map[string]bool, accs []Account, fmt_balance func(string) string) {
+	print_line := func(has_children bool) {
+		if printed[parent.Id] == false && parent.Id != "" {
+			for i := 0; i < level; i++ {
+				fmt.Printf("┆")
+			}
+			if has_children {
+				fmt.Printf("├┬ %s %s: %s\n", Bold(parent.Id), parent.Name, fmt_balance(parent.Id))
+			} else {
+				fmt.Printf("├─ %s %s: %s\n", Bold(parent.Id), parent.Name, fmt_balance(parent.Id))
+			}
+			printed[parent.Id] = true
+		}
+	}
+
+	for _, acc := range accs {
+		if acc.ParentId == parent.Id && !printed[acc.Id] {
+			// Print this account
+			print_line(true)
+			// Print children
+			account_balance_print_children(level+1, acc, printed, accs, fmt_balance)
+		}
+	}
+	print_line(false)
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/chzyer/readline"
+	. "github.com/logrusorgru/aurora"
+	"github.com/satori/go.uuid"
+)
+
+// How much is planned for an account (optionally only for parts with Tag) in an asset during a period
+type Budget struct {
+	Id          string
+	AccountId   string
+	Tag         string
+	AssetKindId string
+	Amount      int
+	Period      TimePeriod
+}
+
+var PcItemBudget = readline.PcItemDynamic(CompleteBudgetFunc)
+
+func NewBudget() *Budget {
+	b := Budget{}
+	b.Init()
+	return &b
+}
+
+func (b *Budget) Init() {
+	if b.Id == "" {
+		b.Id = uuid.NewV4().String()
+	}
+}
+
+func (b Budget) TypeName() string {
+	return "Budget"
+}
+
+// Budgets for different tags of the same asset are reported apart
+func (b Budget) Key() string {
+	return budget_key(b.AssetKindId, b.Tag)
+}
+
+func budget_key(asset_id, tag string) string {
+	return asset_id + "\x00" + tag
+}
+
+func split_budget_key(key string) (string, string) {
+	tmp := strings.SplitN(key, "\x00", 2)
+	return tmp[0], tmp[1]
+}
+
+func (b Budget) AmountToStr() string {
+	s, err := full_decimal_fmt(b.Amount, b.AssetKindId)
+	if err != nil {
+		log.Println(err)
+	}
+	return s
+}
+
+func (b Budget) ANSIString() string {
+	tag := ""
+	if b.Tag != "" {
+		tag = "#" + b.Tag
+	}
+	return fmt.Sprintf("%s %-14.14s %-10.10s %s %s %s", Sprintf(Gray(b.Id)), b.AccountId, tag, Cyan(fmt.Sprintf("%11.11s", b.AmountToStr())), Bold(fmt.Sprintf("%3.3s", b.AssetKindId)), b.Period.StringDay())
+}
+
+func (b Budget) MultilineString() string {
+	s := ""
+	s += fmt.Sprintf("%s %s\n", Bold("         Id:"), b.Id)
+	s += fmt.Sprintf("%s %s\n", Bold("  AccountId:"), b.AccountId)
+	s += fmt.Sprintf("%s %s\n", Bold("        Tag:"), b.Tag)
+	s += fmt.Sprintf("%s %s\n", Bold("AssetKindId:"), b.AssetKindId)
+	s += fmt.Sprintf("%s %s\n", Bold("     Amount:"), b.AmountToStr())
+	s += fmt.Sprintf("%s %s\n", Bold("     Period:"), b.Period.StringDay())
+	return s
+}
+
+func (b *Budget) Load(id string) error {
+	var start, end int64
+	err := DB.QueryRow("SELECT `Id`, `AccountId`, `Tag`, `AssetKindId`, `Amount`, `Start`, `End` FROM `Budget` WHERE `Id` = ?", id).
+		Scan(&b.Id, &b.AccountId, &b.Tag, &b.AssetKindId, &b.Amount, &start, &end)
+	b.Period.Start = time.Unix(start, 0).UTC()
+	b.Period.End = time.Unix(end, 0).UTC()
+	return err
+}
+
+func (b *Budget) Save() error {
+	return WithTx(b.SaveWith)
+}
+
+func (b *Budget) SaveWith(q Querier) error {
+	b.Init()
+	if len(b.AccountId) <= 0 || len(b.AssetKindId) <= 0 {
+		return errors.New("All budgets must have an account and an asset")
+	}
+	_, err := q.Exec("INSERT INTO `Budget` (`Id`, `AccountId`, `Tag`, `AssetKindId`, `Amount`, `Start`, `End`) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		b.Id, b.AccountId, b.Tag, b.AssetKindId, b.Amount, b.Period.Start.Unix(), b.Period.End.Unix())
+	return err
+}
+
+func (b *Budget) Update() error {
+	_, err := DB.Exec("UPDATE `Budget` SET `AccountId` = ?, `Tag` = ?, `AssetKindId` = ?, `Amount` = ?, `Start` = ?, `End` = ? WHERE `Id` = ?",
+		b.AccountId, b.Tag, b.AssetKindId, b.Amount, b.Period.Start.Unix(), b.Period.End.Unix(), b.Id)
+	return err
+}
+
+func (b Budget) Del(id string) error {
+	return b.DelWith(DB, id)
+}
+
+func (b Budget) DelWith(q Querier, id string) error {
+	_, err := q.Exec("DELETE FROM `Budget` WHERE `Id` = ?", id)
+	return err
+}
+
+// Share of the amount that falls inside the period, proportional to the overlapping time
+func (b Budget) AmountIn(period TimePeriod) int {
+	start, end := b.Period.Start, b.Period.End
+	if period.Start.After(start) {
+		start = period.Start
+	}
+	if period.End.Before(end) {
+		end = period.End
+	}
+	total := b.Period.End.Sub(b.Period.Start)
+	if !end.After(start) || total <= 0 {
+		return 0
+	}
+	if !start.After(b.Period.Start) && !end.Before(b.Period.End) {
+		return b.Amount
+	}
+	return int(float64(b.Amount) * float64(end.Sub(start)) / float64(total))
+}
+
+func load_budgets(spec string) []Budget {
+	rows, err := DB.Query("SELECT `Id` FROM `Budget` WHERE `AccountId` = ? OR `Tag` = ? OR ? = '' ORDER BY `AccountId`, `Start`", spec, spec, spec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ids := make([]string, 0)
+	for rows.Next() {
+		id := ""
+		err := rows.Scan(&id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	ans := make([]Budget, 0, len(ids))
+	for _, id := range ids {
+		b := Budget{}
+		err := b.Load(id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ans = append(ans, b)
+	}
+	return ans
+}
+
+// Usage: budget report <period> [account]
+// Actuals are the finished parts of the period (parts also count under the tags of their transaction).
+// Budgets only partially inside the period count proportionally. Plans and actuals roll up through the account tree.
+func budget_report(line []string) {
+	usage := "Usage: budget report <period> [account]"
+	if len(line) == 0 {
+		print_err(Red(usage))
+		return
+	}
+	// The period is either one or two words
+	period, err := ParseTimePeriod(line[0])
+	rest := line[1:]
+	if len(line) > 1 {
+		if tmp, err2 := ParseTimePeriod(line[0] + " " + line[1]); err2 == nil {
+			period, err = tmp, nil
+			rest = line[2:]
+		}
+	}
+	if err != nil || len(rest) > 1 {
+		print_err(Red(usage))
+		return
+	}
+	root := Account{}
+	if len(rest) == 1 {
+		err = root.Load(rest[0])
+		if err != nil {
+			print_err(err.Error())
+			return
+		}
+	}
+
+	// Plans
+	direct_plans := make(map[string]Balance)
+	tags := make(map[string]bool)
+	for _, b := range load_budgets("") {
+		if !b.Period.Start.Before(period.End) || !period.Start.Before(b.Period.End) {
+			continue
+		}
+		val := b.AmountIn(period)
+		if direct_plans[b.AccountId] == nil {
+			direct_plans[b.AccountId] = make(Balance)
+		}
+		direct_plans[b.AccountId][b.Key()] += val
+		if b.Tag != "" {
+			tags[b.Tag] = true
+		}
+	}
+	// Actuals, counted once for all parts and once more for each budgeted tag they have
+	all_tags := load_all_tags()
+	direct_actuals := make(map[string]Balance)
+	for _, tp := range load_parts_in_period(period) {
+		if tp.Status != TS_FINISHED {
+			continue
+		}
+		if direct_actuals[tp.AccountId] == nil {
+			direct_actuals[tp.AccountId] = make(Balance)
+		}
+		direct_actuals[tp.AccountId][budget_key(tp.AssetKindId, "")] += tp.Value
+		for tag := range tags {
+			if all_tags["TransactionPart\x00"+tp.Id][tag] || all_tags["Transaction\x00"+tp.TransactionId][tag] {
+				direct_actuals[tp.AccountId][budget_key(tp.AssetKindId, tag)] += tp.Value
+			}
+		}
+	}
+
+	accs := load_accounts()
+	plans := rollup_balances(accs, direct_plans)
+	actuals := rollup_balances(accs, direct_actuals)
+	kinds := load_asset_kinds()
+	fmt.Printf("%s %s\n", Bold("Budget for"), Gray(period.StringDay()))
+	fmt.Printf("%-32s %-14s %14s %14s %14s %7s\n", "", "", "Plan", "Actual", "Remaining", "Used")
+	printed := make(map[string]bool)
+	var print_tree func(level int, acc Account)
+	print_tree = func(level int, acc Account) {
+		if printed[acc.Id] {
+			return
+		}
+		printed[acc.Id] = true
+		if len(plans[acc.Id]) > 0 {
+			budget_print_account(level, acc, plans[acc.Id], actuals[acc.Id], kinds)
+		}
+		for _, child := range accs {
+			if child.ParentId == acc.Id && child.Id != acc.Id {
+				print_tree(level+1, child)
+			}
+		}
+	}
+	if root.Id != "" {
+		print_tree(0, root)
+		return
+	}
+	for _, acc := range accs {
+		if acc.ParentId == "" {
+			print_tree(0, acc)
+		}
+	}
+}
+
+func budget_print_account(level int, acc Account, plan, actual Balance, kinds map[string]AssetKind) {
+	for i, key := range plan.AssetIds() {
+		asset_id, tag := split_budget_key(key)
+		places := kinds[asset_id].DecimalPlaces
+		name := ""
+		if i == 0 {
+			name = strings.Repeat("┆", level) + "├─ " + acc.Id
+		}
+		label := asset_id
+		if tag != "" {
+			label += " #" + tag
+		}
+		remaining := plan[key] - actual[key]
+		used := "-"
+		if plan[key] != 0 {
+			used = fmt.Sprintf("%.0f%%", 100*float64(actual[key])/float64(plan[key]))
+		}
+		rem := fmt_decimal_pad(remaining, places, 11)
+		// Overspent when past the plan in the direction of the plan (plans may be negative, e.g. for income)
+		over := (plan[key] >= 0 && remaining < 0) || (plan[key] < 0 && remaining > 0)
+		if over {
+			rem = Sprintf(Red(rem))
+			used = Sprintf(Bold(Red(fmt.Sprintf("%7s", used))))
+		} else {
+			rem = Sprintf(Green(rem))
+			used = Sprintf(Green(fmt.Sprintf("%7s", used)))
+		}
+		fmt.Printf("%-32s %-14s %s %s %s %s\n", name, label, fmt_decimal_pad(plan[key], places, 11), fmt_decimal_pad(actual[key], places, 11), rem, used)
+	}
+}
+
+func budget_ask(b *Budget) error {
+	b.AccountId = ask_user(
+		LocalLine,
+		Sprintf(Bold("AccountId: ")),
+		b.AccountId,
+		CompleterAccount,
+		IsAccount)
+	b.Tag = ask_user(
+		LocalLine,
+		Sprintf(Bold("      Tag: ")),
+		b.Tag,
+		readline.NewPrefixCompleter(PcItemTag),
+		func(s string) bool { return !strings.ContainsAny(s, " ,") })
+	b.AssetKindId = ask_user(
+		LocalLine,
+		Sprintf(Bold("    Asset: ")),
+		b.AssetKindId,
+		CompleterAssetKind,
+		IsAssetKind)
+	amount := ""
+	if b.Amount != 0 {
+		amount = b.AmountToStr()
+	}
+	amount = ask_user(
+		LocalLine,
+		Sprintf(Bold("   Amount: ")),
+		amount,
+		nil,
+		IsFloat)
+	var err error
+	b.Amount, err = full_decimal_parse(amount, b.AssetKindId)
+	if err != nil {
+		return err
+	}
+	period := ""
+	if !b.Period.Start.IsZero() {
+		period = b.Period.StringDay()
+	}
+	period = ask_user(
+		LocalLine,
+		Sprintf(Bold("   Period: ")),
+		period,
+		nil,
+		func(s string) bool {
+			_, err := ParseTimePeriod(s)
+			return err == nil
+		})
+	b.Period, err = ParseTimePeriod(period)
+	return err
+}
+
+func budget_show(line []string) {
+	spec := ""
+	if len(line) > 0 {
+		spec = line[0]
+	}
+	b := NewBudget()
+	err := b.Load(spec)
+	if err == nil {
+		fmt.Printf(b.MultilineString())
+		return
+	}
+	for _, b := range load_budgets(spec) {
+		fmt.Println(b.ANSIString())
+	}
+}
+
+// Besides a single budget, adds one budget per day, week, month or year of a longer period
+func budget_add(line []string) {
+	b := NewBudget()
+	err := budget_ask(b)
+	if err != nil {
+		print_err(err.Error())
+		return
+	}
+	split := ask_user(
+		LocalLine,
+		Sprintf(Bold("    Split: ")),
+		"",
+		readline.NewPrefixCompleter(PcItemPeriodUnits...),
+		func(s string) bool { return s == "" || IsPeriodUnit(s) })
+	budgets := []Budget{*b}
+	if split != "" {
+		budgets = make([]Budget, 0)
+		subs := b.Period.Split(split)
+		left := b.Amount
+		for k, sub := range subs {
+			tmp := *b
+			tmp.Id = ""
+			tmp.Init()
+			// The first and last buckets may extend beyond the period
+			if sub.Start.Before(b.Period.Start) {
+				sub.Start = b.Period.Start
+			}
+			if sub.End.After(b.Period.End) {
+				sub.End = b.Period.End
+			}
+			tmp.Period = sub
+			// The amount is spread pro rata, the last budget takes what rounding left over
+			tmp.Amount = b.AmountIn(sub)
+			if k == len(subs)-1 {
+				tmp.Amount = left
+			}
+			left -= tmp.Amount
+			budgets = append(budgets, tmp)
+		}
+	}
+	err = WithTx(func(q Querier) error {
+		for _, b := range budgets {
+			err := b.SaveWith(q)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		print_err(err.Error())
+		return
+	}
+	for _, b := range budgets {
+		fmt.Println(b.ANSIString())
+	}
+}
+
+func budget_edit(line []string) {
+	if len(line) == 0 {
+		print_err(Red("No id specified"))
+		return
+	}
+	b := NewBudget()
+	err := b.Load(line[len(line)-1])
+	if err != nil {
+		print_err(err.Error())
+		return
+	}
+	fmt.Println(Bold("       Id:"), b.Id, Gray("(non editable)"))
+	err = budget_ask(b)
+	if err != nil {
+		print_err(err.Error())
+		return
+	}
+	err = b.Update()
+	if err != nil {
+		print_err(err.Error())
+	}
+}
+
+func budget_del(line []string) {
+	if len(line) == 0 {
+		print_err(Red("No id specified"))
+		return
+	}
+	id := line[len(line)-1]
+	deleter(id, NewBudget())
+}
+
+func CompleteBudgetFunc(prefix string) []string {
+	tmp := strings.Split(prefix, " ")
+	spec := tmp[len(tmp)-1]
+	found := make([]string, 0)
+	for _, id := range load_ids("Budget") {
+		if strings.HasPrefix(id, spec) {
+			found = append(found, id)
+		}
+	}
+	return found
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/chzyer/readline"
+	. "github.com/logrusorgru/aurora"
+)
+
+// A row whose Column points to an object that does not exist in TargetTable
+type DanglingRef struct {
+	Table       string
+	Id          string
+	Column      string
+	Target      string
+	TargetTable string
+	AllowEmpty  bool
+}
+
+func (dr DanglingRef) ANSIString() string {
+	return fmt.Sprintf("%s %s: %s %s %s", Bold(dr.Table), Gray(dr.Id), dr.Column, Red(dr.Target), Gray("(missing "+dr.TargetTable+")"))
+}
+
+// Every reference between tables. Empty references are only allowed for Account.ParentId, TransactionPart.ReconciliationId and RecurringOccurrence.TransactionId.
+// Owned rows are deleted (or cleared) together with the object they reference by its DelWith (e.g. a transaction's parts or any tag).
+// Tags refer to objects of every table, told apart by their ObjectType.
+var CheckedRefs = []struct {
+	Table       string
+	Column      string
+	TargetTable string
+	AllowEmpty  bool
+	Owned       bool
+}{
+	{"Account", "ParentId", "Account", true, false},
+	{"AssetValue", "AssetId", "AssetKind", false, false},
+	{"AssetValue", "RefId", "AssetKind", false, false},
+	{"TransactionPart", "TransactionId", "Transaction", false, true},
+	{"TransactionPart", "AccountId", "Account", false, false},
+	{"TransactionPart", "AssetKindId", "AssetKind", false, false},
+	{"TransactionItem", "TransactionId", "Transaction", false, true},
+	{"TransactionItem", "AssetKindId", "AssetKind", false, false},
+	{"CsvProfile", "AccountId", "Account", false, false},
+	{"CsvProfile", "AssetKindId", "AssetKind", false, false},
+	{"Budget", "AccountId", "Account", false, false},
+	{"Budget", "AssetKindId", "AssetKind", false, false},
+	{"Reconciliation", "AccountId", "Account", false, false},
+	{"Reconciliation", "AssetKindId", "AssetKind", false, false},
+	{"TransactionPart", "ReconciliationId", "Reconciliation", true, false},
+	{"RecurringOccurrence", "RecurringId", "Recurring", false, true},
+	{"RecurringOccurrence", "TransactionId", "Transaction", true, true},
+	{"Tags", "ObjectId", "Account", false, true},
+	{"Tags", "ObjectId", "AssetKind", false, true},
+	{"Tags", "ObjectId", "AssetValue", false, true},
+	{"Tags", "ObjectId", "Transaction", false, true},
+	{"Tags", "ObjectId", "TransactionPart", false, true},
+	{"Tags", "ObjectId", "TransactionItem", false, true},
+}
+
+// Tables without an Id column are addressed by their SQLite rowid
+func id_column(table string) string {
+	if table == "Tags" || table == "RecurringOccurrence" {
+		return "rowid"
+	}
+	return "Id"
+}
+
+func find_dangling_refs() []DanglingRef {
+	ans := make([]DanglingRef, 0)
+	for _, ref := range CheckedRefs {
+		query := fmt.Sprintf("SELECT `%s`, `%s` FROM `%s` WHERE `%s` NOT IN (SELECT `Id` FROM `%s`)", id_column(ref.Table), ref.Column, ref.Table, ref.Column, ref.TargetTable)
+		if ref.AllowEmpty {
+			query += fmt.Sprintf(" AND `%s` != ''", ref.Column)
+		}
+		if ref.Table == "Tags" {
+			query += fmt.Sprintf(" AND `ObjectType` = '%s'", ref.TargetTable)
+		}
+		rows, err := DB.Query(query)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for rows.Next() {
+			dr := DanglingRef{Table: ref.Table, Column: ref.Column, TargetTable: ref.TargetTable, AllowEmpty: ref.AllowEmpty}
+			err := rows.Scan(&dr.Id, &dr.Target)
+			if err != nil {
+				log.Fatal(err)
+			}
+			ans = append(ans, dr)
+		}
+		rows.Close()
+	}
+	return ans
+}
+
+// Returns every cycle in the account tree as a list of account ids
+func find_account_cycles() [][]string {
+	parent := make(map[string]string)
+	for _, acc := range load_accounts() {
+		parent[acc.Id] = acc.ParentId
+	}
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int)
+	cycles := make([][]string, 0)
+	for start := range parent {
+		path := make([]string, 0)
+		cur := start
+		for cur != "" && state[cur] == unvisited {
+			if _, ok := parent[cur]; !ok {
+				break
+			}
+			state[cur] = visiting
+			path = append(path, cur)
+			cur = parent[cur]
+		}
+		// Found a cycle if we came back to the path being walked
+		if cur != "" && state[cur] == visiting {
+			for i, id := range path {
+				if id == cur {
+					cycles = append(cycles, append([]string{}, path[i:]...))
+					break
+				}
+			}
+		}
+		for _, id := range path {
+			state[id] = done
+		}
+	}
+	return cycles
+}
+
+func exists_in(table string) func(string) bool {
+	return func(s string) bool {
+		n := 0
+		err := DB.QueryRow("SELECT COUNT() FROM `"+table+"` WHERE `Id` = ?", s).Scan(&n)
+		return n > 0 && err == nil
+	}
+}
+
+func completer_for(table string) *readline.PrefixCompleter {
+	switch table {
+	case "Account":
+		return CompleterAccount
+	case "AssetKind":
+		return CompleterAssetKind
+	case "Transaction":
+		return CompleterTransaction
+	}
+	return CompleterEmpty
+}
+
+func create_placeholder(table, id string) error {
+	switch table {
+	case "Account":
+		acc := NewAccount()
+		acc.Id = id
+		acc.Name = "Placeholder " + id
+		acc.Desc = "Created by check"
+		return acc.Save()
+	case "AssetKind":
+		ak := NewAssetKind()
+		ak.Id = id
+		ak.Name = "Placeholder " + id
+		ak.Desc = "Created by check"
+		return ak.Save()
+	case "Transaction":
+		_, err := DB.Exec("INSERT INTO `Transaction` (`Id`, `Name`, `Desc`, `RefStart`, `RefEnd`) VALUES (?, ?, ?, 0, 0)", id, "Placeholder "+id, "Created by check")
+		return err
+	}
+	return NotImplementedErr
+}
+
+func check_repair_ref(dr DanglingRef) {
+	fmt.Println(dr.ANSIString())
+	// Optional references may simply be cleared instead of deleting the whole row (e.g. unlocking a reconciled part)
+	prompt := "[r]eassign, [d]elete, create [p]laceholder or [s]kip? "
+	if dr.AllowEmpty {
+		prompt = "[r]eassign, [c]lear, [d]elete, create [p]laceholder or [s]kip? "
+	}
+	choice := ask_user_key(
+		"repair",
+		LocalLine,
+		Sprintf(Bold(prompt)),
+		"s",
+		nil,
+		func(s string) bool {
+			return s == "r" || s == "d" || s == "p" || s == "s" || (s == "c" && dr.AllowEmpty)
+		})
+	var err error
+	switch choice {
+	case "r":
+		target := ask_user(
+			LocalLine,
+			Sprintf(Bold(fmt.Sprintf("New %s: ", dr.Column))),
+			"",
+			completer_for(dr.TargetTable),
+			exists_in(dr.TargetTable))
+		_, err = DB.Exec(fmt.Sprintf("UPDATE `%s` SET `%s` = ? WHERE `%s` = ?", dr.Table, dr.Column, id_column(dr.Table)), target, dr.Id)
+	case "c":
+		_, err = DB.Exec(fmt.Sprintf("UPDATE `%s` SET `%s` = '' WHERE `%s` = ?", dr.Table, dr.Column, id_column(dr.Table)), dr.Id)
+	case "d":
+		_, err = DB.Exec(fmt.Sprintf("DELETE FROM `%s` WHERE `%s` = ?", dr.Table, id_column(dr.Table)), dr.Id)
+	case "p":
+		// A previous repair may have already created it
+		if !exists_in(dr.TargetTable)(dr.Target) {
+			err = create_placeholder(dr.TargetTable, dr.Target)
+		}
+	}
+	if err != nil {
+		print_err(Red(err.Error()))
+	}
+}
+
+func check_repair_cycle(cycle []string) {
+	fmt.Printf("%s %s\n", Bold("Account cycle:"), Red(strings.Join(append(cycle, cycle[0]), " → ")))
+	in_cycle := make(map[string]bool)
+	for _, id := range cycle {
+		in_cycle[id] = true
+	}
+	acc_id := ask_user(
+		LocalLine,
+		Sprintf(Bold("Account to reparent (empty to skip): ")),
+		"",
+		CompleterAccount,
+		func(s string) bool { return s == "" || in_cycle[s] })
+	if acc_id == "" {
+		return
+	}
+	// Moving the account under one of its descendants (the rest of the cycle included) would close another cycle
+	subtree := account_subtree(load_accounts(), acc_id)
+	parent_id := ask_user(
+		LocalLine,
+		Sprintf(Bold("New ParentId: ")),
+		"",
+		CompleterAccount,
+		func(s string) bool { return IsAccountOrEmpty(s) && !subtree[s] })
+	_, err := DB.Exec("UPDATE `Account` SET `ParentId` = ? WHERE `Id` = ?", parent_id, acc_id)
+	if err != nil {
+		print_err(Red(err.Error()))
+	}
+}
+
+// Usage: check
+// Scans the whole database for dangling references and cycles in the account tree.
+func check(line []string) {
+	refs := find_dangling_refs()
+	cycles := find_account_cycles()
+	for _, dr := range refs {
+		fmt.Println(dr.ANSIString())
+	}
+	for _, cycle := range cycles {
+		fmt.Printf("%s %s\n", Bold("Account cycle:"), Red(strings.Join(append(cycle, cycle[0]), " → ")))
+	}
+	if len(refs) == 0 && len(cycles) == 0 {
+		fmt.Println(Green("No problems found"))
+		return
+	}
+	fmt.Println(Bold(fmt.Sprintf("%d dangling reference(s) and %d account cycle(s) found", len(refs), len(cycles))))
+
+	flag := ToBool(ask_user(
+		LocalLine,
+		Sprintf(Bold("Repair interactively? [y/n] ")),
+		"",
+		nil,
+		IsBool))
+	if !flag {
+		return
+	}
+	for _, dr := range refs {
+		check_repair_ref(dr)
+	}
+	for _, cycle := range cycles {
+		check_repair_cycle(cycle)
+	}
+	for _, cycle := range find_account_cycles() {
+		print_err(Red("Account cycle left: " + strings.Join(append(cycle, cycle[0]), " → ")))
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	. "github.com/logrusorgru/aurora"
+	"github.com/mgutz/str"
+)
+
+// False when running commands from the command line, -c or a pipe, in which case nothing is ever prompted
+var Interactive = true
+
+// Set when any command run non interactively failed, so that the program exits with an error code
+var BatchFailed = false
+
+// When positive, answers given as '--key.N' (N = AnswerIndex) take precedence over '--key'.
+// Used for questions repeated once per element of a list, such as the parts of a new transaction.
+var AnswerIndex = 0
+
+// Answers given as flags (e.g. '--name Foo') to the command being run. See ask_user.
+var Answers = make(map[string]string)
+
+// Raised (through panic) by ask_user when an answer is needed but cannot be prompted for
+type MissingAnswerErr struct {
+	Key string
+}
+
+func (e MissingAnswerErr) Error() string {
+	return "Missing or invalid --" + e.Key
+}
+
+var ansi_regexp = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+func stdin_is_terminal() bool {
+	stat, err := os.Stdin.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// Flags are matched ignoring case, dashes and underscores. E.g.: '--Parent-Id' = '--parentid'
+func norm_flag(s string) string {
+	s = strings.ToLower(s)
+	s = strings.Replace(s, "-", "", -1)
+	return strings.Replace(s, "_", "", -1)
+}
+
+// Derives the flag name from the prompt text. E.g.: 'Scheduled for: ' -> 'scheduledfor'
+func prompt_key(prompt string) string {
+	prompt = ansi_regexp.ReplaceAllString(prompt, "")
+	if i := strings.IndexAny(prompt, ":?["); i >= 0 {
+		prompt = prompt[:i]
+	}
+	key := ""
+	for _, r := range strings.ToLower(prompt) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			key += string(r)
+		}
+	}
+	return key
+}
+
+// Separates '--key value' and '--key=value' flags from the other arguments.
+// A flag followed by another flag (or nothing) is set to 'y'.
+// '--tag' and everything after it are left alone since they form a tag expression.
+func split_flags(line []string) ([]string, map[string]string) {
+	args := make([]string, 0)
+	flags := make(map[string]string)
+	for i := 0; i < len(line); i++ {
+		arg := line[i]
+		if arg == "--tag" {
+			args = append(args, line[i:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "--") || len(arg) == 2 {
+			args = append(args, arg)
+			continue
+		}
+		key := arg[2:]
+		if j := strings.Index(key, "="); j >= 0 {
+			flags[norm_flag(key[:j])] = key[j+1:]
+			continue
+		}
+		if i+1 < len(line) && !strings.HasPrefix(line[i+1], "--") {
+			flags[norm_flag(key)] = line[i+1]
+			i++
+		} else {
+			flags[norm_flag(key)] = "y"
+		}
+	}
+	return args, flags
+}
+
+// Looks for the answer to key among the flags. Ids may be given without the 'id' suffix (e.g. '--parent' for 'ParentId').
+func lookup_answer(key string) (string, bool) {
+	if AnswerIndex > 0 {
+		if val, ok := lookup_flag(fmt.Sprintf("%s.%d", key, AnswerIndex)); ok {
+			return val, true
+		}
+	}
+	return lookup_flag(key)
+}
+
+func lookup_flag(key string) (string, bool) {
+	if val, ok := Answers[key]; ok {
+		return val, true
+	}
+	// Also handles indexed keys: '--account.2' for 'accountid.2'
+	base, index := key, ""
+	if i := strings.Index(key, "."); i >= 0 {
+		base, index = key[:i], key[i:]
+	}
+	if strings.HasSuffix(base, "id") {
+		val, ok := Answers[strings.TrimSuffix(base, "id")+index]
+		return val, ok
+	}
+	return "", false
+}
+
+// Runs a command with its flags. Returns false when the program should exit.
+func run_scripted(line []string) bool {
+	args, flags := split_flags(line)
+	Answers = flags
+	defer func() {
+		Answers = make(map[string]string)
+		AnswerIndex = 0
+		if r := recover(); r != nil {
+			err, ok := r.(MissingAnswerErr)
+			if !ok {
+				panic(r)
+			}
+			print_err(Red(err.Error()))
+		}
+	}()
+	return execute(args)
+}
+
+// Prints why a command failed. Non interactive runs will then exit with an error code.
+func print_err(a ...interface{}) {
+	if !Interactive {
+		BatchFailed = true
+	}
+	fmt.Println(a...)
+}
+
+// Splits commands separated by ';' or new lines, except inside quotes (e.g. "account add --desc 'a; b'; account show")
+func split_commands(input string) []string {
+	ans := make([]string, 0)
+	cur := ""
+	quote := rune(0)
+	escaped := false
+	for _, r := range input {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '"' || r == '\''):
+			quote = r
+		case quote == 0 && (r == ';' || r == '\n'):
+			ans = append(ans, cur)
+			cur = ""
+			continue
+		}
+		cur += string(r)
+	}
+	return append(ans, cur)
+}
+
+// Runs a single command line, skipping empty ones and comments (starting with '#'). Returns false when the program should exit.
+func run_line(raw_line string) bool {
+	raw_line = strings.TrimSpace(raw_line)
+	if raw_line == "" || strings.HasPrefix(raw_line, "#") {
+		return true
+	}
+	return run_scripted(str.ToArgv(raw_line))
+}
+
+// Runs one command per line. Empty lines and lines starting with '#' are skipped.
+func run_batch(input io.Reader) {
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		if !run_line(scanner.Text()) {
+			return
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/chzyer/readline"
+	. "github.com/logrusorgru/aurora"
+)
+
+type Command struct {
+	Path      []string                            // Words that select the command, e.g. {"asset", "kind", "show"}
+	Args      string                              // Argument spec shown in the help, e.g. "<id>"
+	Help      string                              // One line description
+	Completer []readline.PrefixCompleterInterface // Completes the arguments (optional)
+	Run       func(line []string)                 // Receives only the arguments. Nil for 'exit'.
+}
+
+func (cmd Command) Name() string {
+	return strings.Join(cmd.Path, " ")
+}
+
+func (cmd Command) ANSIString() string {
+	return fmt.Sprintf("%s %s\n    %s", Bold(cmd.Name()), Cyan(cmd.Args), cmd.Help)
+}
+
+// Every command, in the order they are listed in the help. Filled by init() since 'help' refers back to it.
+var Commands []Command
+
+// Built from Commands so that completion always matches what execute accepts
+var Completer *readline.PrefixCompleter
+
+func pc(items ...readline.PrefixCompleterInterface) []readline.PrefixCompleterInterface {
+	return items
+}
+
+func init() {
+	Commands = []Command{
+		{[]string{"help"}, "[command]", "Show every command or only the ones starting with the given words", nil, help},
+		{[]string{"exit"}, "", "Leave wedge", nil, nil},
+		{[]string{"check"}, "", "Look for dangling references and account cycles, optionally repairing them", nil, check},
+		{[]string{"db", "version"}, "", "Show the schema version and pending migrations", nil, db_version},
+		{[]string{"db", "migrate"}, "[version]", "Back up the database and apply pending migrations", nil, db_migrate},
+		{[]string{"export", "json"}, "<file>", "Save every account, asset, transaction and tag to a JSON file", nil, export_json},
+		{[]string{"import", "json"}, "<file> [merge|replace]", "Load a JSON file made by 'export json'", nil, import_json},
+		{[]string{"export", "ledger"}, "<file>", "Write a ledger/hledger journal with accounts, commodities, prices and transactions", nil, export_ledger},
+		{[]string{"import", "ledger"}, "<file> [dry-run]", "Read a ledger/hledger journal, creating missing accounts and asset kinds", nil, import_ledger_journal},
+		{[]string{"import", "csv"}, "<profile> <file> [dry-run]", "Preview a bank CSV statement and save it as one transaction", pc(PcItemCsvProfile), import_csv},
+		{[]string{"import", "ofx"}, "<file> <account> <asset> [dry-run]", "Preview an OFX/QFX statement and save its new entries as transactions", nil, import_ofx},
+		{[]string{"csv", "profile", "show"}, "[id]", "Show CSV import profiles", pc(PcItemCsvProfile), csv_profile_show},
+		{[]string{"csv", "profile", "add"}, "", "Add a CSV import profile", nil, csv_profile_add},
+		{[]string{"csv", "profile", "edit"}, "<id>", "Edit a CSV import profile", pc(PcItemCsvProfile), csv_profile_edit},
+		{[]string{"csv", "profile", "del"}, "<id>", "Delete a CSV import profile", pc(PcItemCsvProfile), csv_profile_del},
+		{[]string{"strict"}, "[on|off]", "Show or set whether unbalanced transactions are rejected", pc(readline.PcItem("on"), readline.PcItem("off")), strict},
+		{[]string{"networth"}, "<asset> [date]", "Value every account in a single asset", pc(PcItemAssetKind), networth},
+		{[]string{"forecast"}, "<account> <period>", "Project the daily balance of an account from its scheduled, planned and on going parts", pc(PcItemAccount), forecast},
+		{[]string{"budget", "show"}, "[id|account|tag]", "Show budgets", pc(PcItemBudget), budget_show},
+		{[]string{"budget", "add"}, "", "Add a budget, optionally one per day, week, month or year of a period", nil, budget_add},
+		{[]string{"budget", "edit"}, "<id>", "Edit a budget", pc(PcItemBudget), budget_edit},
+		{[]string{"budget", "del"}, "<id>", "Delete a budget", pc(PcItemBudget), budget_del},
+		{[]string{"budget", "report"}, "<period> [account]", "Compare the finished parts of a period against the budgets", nil, budget_report},
+		{[]string{"reconcile"}, "<account>", "Tick the parts of an account off against a bank statement closing balance", pc(PcItemAccount), reconcile},
+		{[]string{"reconciliation", "show"}, "[account]", "Show past reconciliations", pc(PcItemAccount), reconciliation_show},
+		{[]string{"reconciliation", "undo"}, "<id>", "Undo a reconciliation, unlocking its parts", pc(PcItemReconciliation), reconciliation_undo},
+		{[]string{"overdue"}, "[date]", "List scheduled parts whose date has passed", nil, overdue},
+		{[]string{"report", "tags"}, "<day|week|month|year> <period> [--tag <expr>]", "Total items and parts per tag, asset and period", PcItemPeriodUnits, report_tags},
+		{[]string{"tag", "add"}, "<object id> <tag> [tag...]", "Tag an object", nil, tag_add},
+		{[]string{"tag", "del"}, "<object id> <tag> [tag...]", "Remove tags from an object", nil, tag_del},
+		{[]string{"tag", "rename"}, "<old> <new>", "Rename a tag everywhere", pc(PcItemTag), tag_rename},
+		{[]string{"tag", "list"}, "[tag]", "List tags or the objects with a tag", pc(PcItemTag), tag_list},
+		{[]string{"timeline", "summary"}, "<day|week|month|year> <period>", "Inflows, outflows and net change per account and asset", PcItemPeriodUnits, timeline_summary},
+		{[]string{"timeline", "plot"}, "<asset> <day|week|month|year> <period> <account...> [svg <file>]", "Chart the running balance of accounts", pc(PcItemAssetKind), timeline_plot},
+		{[]string{"recurring", "show"}, "[id]", "Show recurring transactions", pc(PcItemRecurring), recurring_show},
+		{[]string{"recurring", "add"}, "", "Add a recurring transaction copying an existing one as template", nil, recurring_add},
+		{[]string{"recurring", "edit"}, "<id>", "Edit a recurring transaction", pc(PcItemRecurring), recurring_edit},
+		{[]string{"recurring", "del"}, "<id>", "Delete a recurring transaction (created transactions are kept)", pc(PcItemRecurring), recurring_del},
+		{[]string{"recurring", "run"}, "<period> [dry-run]", "Create the scheduled transactions due in a period", nil, recurring_run},
+		{[]string{"account", "show"}, "[id|name] [--tag <expr>]", "Show an account or the account tree", pc(PcItemAccount), account_show},
+		{[]string{"account", "add"}, "", "Add an account", nil, account_add},
+		{[]string{"account", "edit"}, "<id>", "Edit an account", pc(PcItemAccount), account_edit},
+		{[]string{"account", "del"}, "<id>", "Delete an account", pc(PcItemAccount), account_del},
+		{[]string{"account", "balance"}, "[id] [date] [cleared|scheduled|projected]", "Per asset balances rolled up through the account tree", pc(PcItemAccount), account_balance},
+		{[]string{"asset", "convert"}, "<value> <from> <to> [date]", "Convert an amount between assets", nil, asset_convert},
+		{[]string{"asset", "value", "show"}, "[id] [--tag <expr>]", "Show asset values", pc(PcItemAssetValue), asset_value_show},
+		{[]string{"asset", "value", "add"}, "", "Add an asset value", nil, asset_value_add},
+		{[]string{"asset", "value", "edit"}, "<id>", "Edit an asset value", pc(PcItemAssetValue), asset_value_edit},
+		{[]string{"asset", "value", "del"}, "<id>", "Delete an asset value", pc(PcItemAssetValue), asset_value_del},
+		{[]string{"asset", "kind", "show"}, "[id|name] [--tag <expr>]", "Show asset kinds", pc(PcItemAssetKind), asset_kind_show},
+		{[]string{"asset", "kind", "add"}, "", "Add an asset kind", nil, asset_kind_add},
+		{[]string{"asset", "kind", "edit"}, "<id>", "Edit an asset kind", pc(PcItemAssetKind), asset_kind_edit},
+		{[]string{"asset", "kind", "del"}, "<id>", "Delete an asset kind", pc(PcItemAssetKind), asset_kind_del},
+		{[]string{"transaction", "show"}, "[id|name] [--tag <expr>]", "Show transactions", pc(PcItemTransaction), transaction_show},
+		{[]string{"transaction", "add"}, "", "Add a transaction with its items and parts", nil, transaction_add},
+		{[]string{"transaction", "del"}, "<id>", "Delete a transaction with its items and parts", pc(PcItemTransaction), transaction_del},
+		{[]string{"transaction", "edit"}, "<id>", "Edit a transaction", pc(PcItemTransaction), transaction_edit},
+		{[]string{"transaction", "check-items"}, "[id]", "Check items against parts", pc(PcItemTransaction), transaction_check_items},
+		{[]string{"transaction", "part", "show"}, "[id|account|status] [--tag <expr>]", "Show transaction parts", pc(PcItemTransactionPart), transaction_part_show},
+		{[]string{"transaction", "part", "show-by-account"}, "<account>", "Show the parts of an account", pc(PcItemAccount), transaction_part_show},
+		{[]string{"transaction", "part", "add"}, "", "Add a transaction part", nil, transaction_part_add},
+		{[]string{"transaction", "part", "del"}, "<id>", "Delete a transaction part", pc(PcItemTransactionPart), transaction_part_del},
+		{[]string{"transaction", "part", "edit"}, "<id>", "Edit a transaction part", pc(PcItemTransactionPart), transaction_part_edit},
+		{[]string{"transaction", "part", "settle"}, "<id> [date] [actual value]", "Finish a part on the given date (today by default)", pc(PcItemTransactionPart), transaction_part_settle},
+		{[]string{"transaction", "item", "show"}, "[id|name] [--tag <expr>]", "Show transaction items", pc(PcItemTransactionItem), transaction_item_show},
+		{[]string{"transaction", "item", "add"}, "", "Add a transaction item", nil, transaction_item_add},
+		{[]string{"transaction", "item", "del"}, "<id>", "Delete a transaction item", pc(PcItemTransactionItem), transaction_item_del},
+		{[]string{"transaction", "item", "edit"}, "<id>", "Edit a transaction item", pc(PcItemTransactionItem), transaction_item_edit},
+	}
+	Completer = build_completer()
+}
+
+func has_prefix(line, prefix []string) bool {
+	if len(line) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if line[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Finds the command whose path is the longest prefix of line
+func find_command(line []string) (Command, bool) {
+	best := -1
+	for i, cmd := range Commands {
+		if has_prefix(line, cmd.Path) && (best < 0 || len(cmd.Path) > len(Commands[best].Path)) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return Command{}, false
+	}
+	return Commands[best], true
+}
+
+// Commands whose path starts with the given words
+func commands_under(words []string) []Command {
+	ans := make([]Command, 0)
+	for _, cmd := range Commands {
+		if has_prefix(cmd.Path, words) {
+			ans = append(ans, cmd)
+		}
+	}
+	return ans
+}
+
+func build_completer() *readline.PrefixCompleter {
+	nodes := make(map[string]*readline.PrefixCompleter)
+	top := make([]readline.PrefixCompleterInterface, 0)
+	for _, cmd := range Commands {
+		for i := range cmd.Path {
+			key := strings.Join(cmd.Path[:i+1], " ")
+			if _, ok := nodes[key]; ok {
+				continue
+			}
+			node := readline.PcItem(cmd.Path[i])
+			nodes[key] = node
+			if i == 0 {
+				top = append(top, node)
+			} else {
+				parent := nodes[strings.Join(cmd.Path[:i], " ")]
+				parent.SetChildren(append(parent.GetChildren(), node))
+			}
+		}
+		leaf := nodes[cmd.Name()]
+		leaf.SetChildren(append(leaf.GetChildren(), cmd.Completer...))
+	}
+	// 'help' completes command names
+	help_node := nodes["help"]
+	for _, node := range top {
+		if node != help_node {
+			help_node.SetChildren(append(help_node.GetChildren(), node))
+		}
+	}
+	return readline.NewPrefixCompleter(top...)
+}
+
+// Usage: help [command]
+func help(line []string) {
+	cmds := commands_under(line)
+	if len(cmds) == 0 {
+		print_err(Red("Unknown command: " + strings.Join(line, " ")))
+		return
+	}
+	for _, cmd := range cmds {
+		fmt.Println(cmd.ANSIString())
+	}
+}
+
+// Runs a single command. Returns false when the program should exit.
+func execute(line []string) bool {
+	if len(line) == 0 {
+		return true
+	}
+	cmd, ok := find_command(line)
+	switch {
+	case ok && cmd.Run == nil:
+		return false
+	case ok:
+		cmd.Run(line[len(cmd.Path):])
+	case len(commands_under(line)) > 0:
+		// Incomplete command such as 'asset kind'
+		fmt.Println(Yellow("Incomplete command, did you mean one of:"))
+		help(line)
+	default:
+		print_err(fmt.Sprintf("Unknown command: %+v (try 'help')", line))
+	}
+	return true
+}
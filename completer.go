@@ -24,44 +24,13 @@ var CompleterTransactionPart = readline.NewPrefixCompleter(PcItemTransactionPart
 var CompleterTransactionItem = readline.NewPrefixCompleter(PcItemTransactionItem)
 var CompleterTransactionStatus = readline.NewPrefixCompleter(PcItemTransactionStatus)
 var CompleterEmpty = readline.NewPrefixCompleter()
-var Completer = readline.NewPrefixCompleter(
-	readline.PcItem("exit"),
-	readline.PcItem("timeline",
-		readline.PcItem("summary"),
-		readline.PcItem("plot")),
-	readline.PcItem("account",
-		readline.PcItem("show", PcItemAccount),
-		readline.PcItem("add"),
-		readline.PcItem("edit", PcItemAccount),
-		readline.PcItem("del", PcItemAccount),
-		readline.PcItem("balance", PcItemAccount)),
-	readline.PcItem("asset",
-		readline.PcItem("value",
-			readline.PcItem("show", PcItemAssetValue),
-			readline.PcItem("add"),
-			readline.PcItem("edit", PcItemAssetValue),
-			readline.PcItem("del", PcItemAssetValue)),
-		readline.PcItem("kind",
-			readline.PcItem("show", PcItemAssetKind),
-			readline.PcItem("add"),
-			readline.PcItem("edit", PcItemAssetKind),
-			readline.PcItem("del", PcItemAssetKind))),
-	readline.PcItem("transaction",
-		readline.PcItem("show", PcItemTransaction),
-		readline.PcItem("add"),
-		readline.PcItem("del", PcItemTransaction),
-		readline.PcItem("edit", PcItemTransaction),
-		readline.PcItem("part",
-			readline.PcItem("show", PcItemTransactionPart),
-			readline.PcItem("add"),
-			readline.PcItem("del", PcItemTransactionPart),
-			readline.PcItem("edit", PcItemTransactionPart),
-			readline.PcItem("show-by-account", PcItemAccount)),
-		readline.PcItem("item",
-			readline.PcItem("show", PcItemTransactionItem),
-			readline.PcItem("add"),
-			readline.PcItem("del", PcItemTransactionItem),
-			readline.PcItem("edit", PcItemTransactionItem))))
+var CompleterTags = TagListCompleter{}
+var PcItemTag = readline.PcItemDynamic(CompleteTagFunc)
+var PcItemPeriodUnits = []readline.PrefixCompleterInterface{
+	readline.PcItem("day"),
+	readline.PcItem("week"),
+	readline.PcItem("month"),
+	readline.PcItem("year")}
 
 const DATE_FMT = "2006-01-02-15:04:05-MST"
 const DATE_FMT_SPACES = "2006-01-02 15:04:05 MST"
@@ -156,7 +125,30 @@ func IsBool(s string) bool {
 	return s == "true" || s == "yes" || s == "on" || s == "1" || s == "y" || s == "false" || s == "no" || s == "off" || s == "0" || s == "n"
 }
 
-func ask_user(line *readline.Instance, prompt string, what string, completer *readline.PrefixCompleter, validator func(string) bool) string {
+func ask_user(line *readline.Instance, prompt string, what string, completer readline.AutoCompleter, validator func(string) bool) string {
+	return ask_user_key(prompt_key(prompt), line, prompt, what, completer, validator)
+}
+
+// Same as ask_user but the answer may be given as the flag '--key'.
+// When not interactive, the default (what) is used if valid, yes/no questions are answered with no and anything else is an error.
+func ask_user_key(key string, line *readline.Instance, prompt string, what string, completer readline.AutoCompleter, validator func(string) bool) string {
+	if val, ok := lookup_answer(key); ok {
+		if validator(val) {
+			return val
+		}
+		if !Interactive {
+			panic(MissingAnswerErr{key})
+		}
+		what = val
+	} else if !Interactive {
+		if validator(what) {
+			return what
+		}
+		if validator("n") && validator("y") {
+			return "n"
+		}
+		panic(MissingAnswerErr{key})
+	}
 	for {
 		line.SetPrompt(prompt)
 		set_completer(line, completer)
@@ -172,7 +164,7 @@ func ask_user(line *readline.Instance, prompt string, what string, completer *re
 	}
 }
 
-func set_completer(line *readline.Instance, completer *readline.PrefixCompleter) {
+func set_completer(line *readline.Instance, completer readline.AutoCompleter) {
 	if completer == nil {
 		completer = CompleterEmpty
 	}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	. "github.com/logrusorgru/aurora"
+)
+
+var NoRateErr = errors.New("No applicable rate found")
+
+// Converts amounts between asset kinds using the AssetValue table.
+// Only rates on or before Date are considered and, for each pair of assets, the most recent one wins.
+// When there is no direct rate, the inverse one is used and, failing that, a chain of rates through other assets.
+type Converter struct {
+	Date  time.Time
+	kinds map[string]AssetKind
+	rates map[string]map[string]float64 // rates[from][to] = how many units of 'to' one unit of 'from' is worth
+}
+
+func NewConverter(date time.Time) *Converter {
+	cv := Converter{Date: date}
+	cv.Init()
+	return &cv
+}
+
+func (cv *Converter) Init() {
+	cv.kinds = load_asset_kinds()
+	cv.rates = make(map[string]map[string]float64)
+
+	rows, err := DB.Query("SELECT `AssetId`, `RefId`, `Value` FROM `AssetValue` WHERE `Date` <= ? ORDER BY `Date` ASC", cv.Date.Unix())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+	direct := make(map[string]bool)
+	for rows.Next() {
+		var asset_id, ref_id string
+		var val int
+		err := rows.Scan(&asset_id, &ref_id, &val)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ref, ok := cv.kinds[ref_id]
+		if !ok || val == 0 {
+			continue
+		}
+		rate := float64(val) / math.Pow10(ref.DecimalPlaces)
+		// Later rows are more recent and so overwrite older ones
+		cv.set_rate(asset_id, ref_id, rate)
+		direct[asset_id+"\x00"+ref_id] = true
+		// Inverse rates never replace direct ones
+		if !direct[ref_id+"\x00"+asset_id] {
+			cv.set_rate(ref_id, asset_id, 1/rate)
+		}
+	}
+}
+
+func (cv *Converter) set_rate(from, to string, rate float64) {
+	if cv.rates[from] == nil {
+		cv.rates[from] = make(map[string]float64)
+	}
+	cv.rates[from][to] = rate
+}
+
+// Returns how many units of 'to' one unit of 'from' is worth and the chain of assets used.
+// The shortest chain is preferred.
+func (cv *Converter) Rate(from, to string) (float64, []string, error) {
+	if from == to {
+		return 1, []string{from}, nil
+	}
+	// Breadth first search over the rates graph
+	prev := map[string]string{from: ""}
+	queue := []string{from}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		if cur == to {
+			break
+		}
+		for next := range cv.rates[cur] {
+			if _, seen := prev[next]; !seen {
+				prev[next] = cur
+				queue = append(queue, next)
+			}
+		}
+	}
+	if _, found := prev[to]; !found {
+		return 0, nil, NoRateErr
+	}
+	// Walk back the path
+	path := []string{to}
+	for cur := to; cur != from; cur = prev[cur] {
+		path = append([]string{prev[cur]}, path...)
+	}
+	rate := 1.0
+	for i := 1; i < len(path); i++ {
+		rate *= cv.rates[path[i-1]][path[i]]
+	}
+	return rate, path, nil
+}
+
+// Converts a raw amount of 'from' into a raw amount of 'to'
+func (cv *Converter) Convert(raw int, from, to string) (int, error) {
+	from_ak, ok := cv.kinds[from]
+	if !ok {
+		return 0, errors.New("Unknown asset kind: " + from)
+	}
+	to_ak, ok := cv.kinds[to]
+	if !ok {
+		return 0, errors.New("Unknown asset kind: " + to)
+	}
+	rate, _, err := cv.Rate(from, to)
+	if err != nil {
+		return 0, err
+	}
+	units := float64(raw) / math.Pow10(from_ak.DecimalPlaces)
+	return int(math.Round(units * rate * math.Pow10(to_ak.DecimalPlaces))), nil
+}
+
+// Converts every asset of the balance into 'to'. Assets without an applicable rate are returned separately.
+func (cv *Converter) ConvertBalance(bal Balance, to string) (int, []string) {
+	total := 0
+	missing := make([]string, 0)
+	for _, asset_id := range bal.AssetIds() {
+		val, err := cv.Convert(bal[asset_id], asset_id, to)
+		if err != nil {
+			missing = append(missing, asset_id)
+			continue
+		}
+		total += val
+	}
+	return total, missing
+}
+
+// Usage: asset convert <value> <from> <to> [date]
+func asset_convert(line []string) {
+	if len(line) < 3 || !IsFloat(line[0]) || !IsAssetKind(line[1]) || !IsAssetKind(line[2]) {
+		print_err(Red("Usage: asset convert <value> <from> <to> [date]"))
+		return
+	}
+	date := time.Now()
+	if len(line) > 3 {
+		if !IsDay(line[3]) {
+			print_err(Red("Invalid date: " + line[3]))
+			return
+		}
+		date, _ = time.Parse(DAY_FMT, line[3])
+		date = EndOfDay(date)
+	}
+	raw, err := full_decimal_parse(line[0], line[1])
+	if err != nil {
+		print_err(err.Error())
+		return
+	}
+
+	cv := NewConverter(date)
+	ans, err := cv.Convert(raw, line[1], line[2])
+	if err != nil {
+		print_err(Red(err.Error()))
+		return
+	}
+	_, path, _ := cv.Rate(line[1], line[2])
+	ans_str, _ := full_decimal_fmt(ans, line[2])
+	raw_str, _ := full_decimal_fmt(raw, line[1])
+	fmt.Printf("%s %s = %s %s %s\n", Cyan(raw_str), Bold(line[1]), Cyan(ans_str), Bold(line[2]), Gray("(via "+strings.Join(path, " → ")+")"))
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/chzyer/readline"
+	. "github.com/logrusorgru/aurora"
+	"github.com/mgutz/str"
+)
+
+// Describes how the CSV files of a bank map to transaction parts.
+// Columns are either 1-based numbers or names found in the last header row.
+type CsvProfile struct {
+	Id           string
+	Delimiter    string
+	HeaderRows   int
+	DateColumn   string
+	DateFormat   string // Either a Go layout or something like DD/MM/YYYY
+	AmountColumn string
+	DecimalSep   string
+	DescColumn   string // Optional, goes to the part memo
+	AccountId    string
+	AssetKindId  string
+}
+
+var PcItemCsvProfile = readline.PcItemDynamic(CompleteCsvProfileFunc)
+
+func NewCsvProfile() *CsvProfile {
+	return &CsvProfile{Delimiter: ",", HeaderRows: 1, DateFormat: "YYYY-MM-DD", DecimalSep: "."}
+}
+
+func (cp CsvProfile) TypeName() string {
+	return "CsvProfile"
+}
+
+func (cp CsvProfile) ANSIString() string {
+	return fmt.Sprintf("%s date=%s (%s) amount=%s desc=%s → %s %s", Bold(cp.Id), cp.DateColumn, cp.DateFormat, cp.AmountColumn, cp.DescColumn, Cyan(cp.AccountId), Bold(cp.AssetKindId))
+}
+
+func (cp CsvProfile) MultilineString() string {
+	s := ""
+	s += fmt.Sprintf("%s %s\n", Bold("           Id:"), cp.Id)
+	s += fmt.Sprintf("%s %q\n", Bold("    Delimiter:"), cp.Delimiter)
+	s += fmt.Sprintf("%s %d\n", Bold("  Header rows:"), cp.HeaderRows)
+	s += fmt.Sprintf("%s %s\n", Bold("  Date column:"), cp.DateColumn)
+	s += fmt.Sprintf("%s %s\n", Bold("  Date format:"), cp.DateFormat)
+	s += fmt.Sprintf("%s %s\n", Bold("Amount column:"), cp.AmountColumn)
+	s += fmt.Sprintf("%s %q\n", Bold("  Decimal sep:"), cp.DecimalSep)
+	s += fmt.Sprintf("%s %s\n", Bold("  Desc column:"), cp.DescColumn)
+	s += fmt.Sprintf("%s %s\n", Bold("    AccountId:"), cp.AccountId)
+	s += fmt.Sprintf("%s %s\n", Bold("  AssetKindId:"), cp.AssetKindId)
+	return s
+}
+
+func (cp *CsvProfile) Load(id string) error {
+	return DB.QueryRow("SELECT `Id`, `Delimiter`, `HeaderRows`, `DateColumn`, `DateFormat`, `AmountColumn`, `DecimalSep`, `DescColumn`, `AccountId`, `AssetKindId` FROM `CsvProfile` WHERE `Id` = ?", id).
+		Scan(&cp.Id, &cp.Delimiter, &cp.HeaderRows, &cp.DateColumn, &cp.DateFormat, &cp.AmountColumn, &cp.DecimalSep, &cp.DescColumn, &cp.AccountId, &cp.AssetKindId)
+}
+
+func (cp CsvProfile) Save() error {
+	return WithTx(cp.SaveWith)
+}
+
+func (cp CsvProfile) SaveWith(q Querier) error {
+	if len(cp.Id) <= 0 {
+		return errors.New("All CSV profiles must have a non empty id")
+	}
+	_, err := q.Exec("INSERT INTO `CsvProfile` (`Id`, `Delimiter`, `HeaderRows`, `DateColumn`, `DateFormat`, `AmountColumn`, `DecimalSep`, `DescColumn`, `AccountId`, `AssetKindId`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		cp.Id, cp.Delimiter, cp.HeaderRows, cp.DateColumn, cp.DateFormat, cp.AmountColumn, cp.DecimalSep, cp.DescColumn, cp.AccountId, cp.AssetKindId)
+	return err
+}
+
+func (cp CsvProfile) Update() error {
+	_, err := DB.Exec("UPDATE `CsvProfile` SET `Delimiter` = ?, `HeaderRows` = ?, `DateColumn` = ?, `DateFormat` = ?, `AmountColumn` = ?, `DecimalSep` = ?, `DescColumn` = ?, `AccountId` = ?, `AssetKindId` = ? WHERE `Id` = ?",
+		cp.Delimiter, cp.HeaderRows, cp.DateColumn, cp.DateFormat, cp.AmountColumn, cp.DecimalSep, cp.DescColumn, cp.AccountId, cp.AssetKindId, cp.Id)
+	return err
+}
+
+func (cp CsvProfile) Del(id string) error {
+	return cp.DelWith(DB, id)
+}
+
+func (cp CsvProfile) DelWith(q Querier, id string) error {
+	_, err := q.Exec("DELETE FROM `CsvProfile` WHERE `Id` = ?", id)
+	return err
+}
+
+// Profiles without a delimiter (e.g. imported from JSON) use commas
+func (cp CsvProfile) Comma() rune {
+	if cp.Delimiter == "tab" || cp.Delimiter == "\\t" {
+		return '\t'
+	}
+	if cp.Delimiter == "" {
+		return ','
+	}
+	return []rune(cp.Delimiter)[0]
+}
+
+// Converts DD/MM/YYYY style formats to Go layouts. Go layouts are returned untouched.
+func date_layout(format string) string {
+	if strings.Contains(format, "2006") || strings.Contains(format, "06") {
+		return format
+	}
+	r := strings.NewReplacer("YYYY", "2006", "YY", "06", "MM", "01", "DD", "02")
+	return r.Replace(format)
+}
+
+// Parses bank amounts such as "-1.234,56", "(12.00)" or "R$ 10,00"
+func parse_amount(input, decimal_sep string, decimal_places int) (int, error) {
+	input = strings.TrimSpace(input)
+	mul := 1
+	if strings.HasPrefix(input, "(") && strings.HasSuffix(input, ")") {
+		mul = -1
+	}
+	digits := ""
+	seps := 0
+	for _, cur_rune := range input {
+		char := string(cur_rune)
+		switch {
+		case char == "-":
+			mul = -1
+		case char == decimal_sep:
+			digits += "."
+			seps++
+		case cur_rune >= '0' && cur_rune <= '9':
+			digits += char
+		}
+	}
+	if seps > 1 || strings.Trim(digits, ".") == "" {
+		return 0, errors.New("invalid amount: " + input)
+	}
+	return parse_decimal(digits, decimal_places) * mul, nil
+}
+
+// Finds the index of a column given by number (1-based) or by its name in the header
+func column_index(spec string, header []string) (int, error) {
+	if IsInt(spec) {
+		return str.ToIntOr(spec, 0) - 1, nil
+	}
+	for i, name := range header {
+		if strings.EqualFold(strings.TrimSpace(name), strings.TrimSpace(spec)) {
+			return i, nil
+		}
+	}
+	return -1, errors.New("no such column: " + spec)
+}
+
+// One line of the statement
+type CsvRow struct {
+	Line  int
+	Date  time.Time
+	Value int
+	Desc  string
+	Err   error
+}
+
+func (cp CsvProfile) ReadRows(filename string, decimal_places int) ([]CsvRow, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	reader := csv.NewReader(fp)
+	reader.Comma = cp.Comma()
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	header := []string{}
+	if cp.HeaderRows > 0 && len(records) >= cp.HeaderRows {
+		header = records[cp.HeaderRows-1]
+	}
+	date_col, err := column_index(cp.DateColumn, header)
+	if err != nil {
+		return nil, err
+	}
+	amount_col, err := column_index(cp.AmountColumn, header)
+	if err != nil {
+		return nil, err
+	}
+	desc_col := -1
+	if cp.DescColumn != "" {
+		desc_col, err = column_index(cp.DescColumn, header)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	layout := date_layout(cp.DateFormat)
+	rows := make([]CsvRow, 0)
+	for i, record := range records {
+		if i < cp.HeaderRows || strings.TrimSpace(strings.Join(record, "")) == "" {
+			continue
+		}
+		row := CsvRow{Line: i + 1}
+		field := func(col int) string {
+			if col < 0 || col >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[col])
+		}
+		if date_col >= len(record) || amount_col >= len(record) {
+			row.Err = errors.New("missing columns")
+		}
+		if row.Err == nil {
+			row.Date, row.Err = time.Parse(layout, field(date_col))
+		}
+		if row.Err == nil {
+			row.Value, row.Err = parse_amount(field(amount_col), cp.DecimalSep, decimal_places)
+		}
+		row.Desc = field(desc_col)
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// Usage: import csv <profile> <file> [dry-run]
+func import_csv(line []string) {
+	usage := "Usage: import csv <profile> <file> [dry-run]"
+	if len(line) < 2 || len(line) > 3 || (len(line) == 3 && line[2] != "dry-run") {
+		print_err(Red(usage))
+		return
+	}
+	dry_run := len(line) == 3
+	cp := NewCsvProfile()
+	err := cp.Load(line[0])
+	if err != nil {
+		print_err(Red("No such CSV profile: " + line[0]))
+		return
+	}
+	ak := AssetKind{}
+	err = ak.Load(cp.AssetKindId)
+	if err != nil {
+		print_err(err.Error())
+		return
+	}
+	rows, err := cp.ReadRows(line[1], ak.DecimalPlaces)
+	if err != nil {
+		print_err(Red(err.Error()))
+		return
+	}
+
+	// Preview
+	tr := NewTransaction()
+	total := 0
+	invalid := 0
+	for _, row := range rows {
+		if row.Err != nil {
+			invalid++
+			fmt.Printf("%4d %s\n", row.Line, Red(row.Err.Error()))
+			continue
+		}
+		num := fmt_decimal_pad(row.Value, ak.DecimalPlaces, 11)
+		if row.Value >= 0 {
+			num = Sprintf(Cyan(num))
+		} else {
+			num = Sprintf(Red(num))
+		}
+		fmt.Printf("%4d %s %s %s %s\n", row.Line, row.Date.Format(DAY_FMT), num, Bold(ak.Id), row.Desc)
+
+		tp := NewTransactionPart()
+		tp.TransactionId = tr.Id
+		tp.AccountId = cp.AccountId
+		tp.AssetKindId = ak.Id
+		tp.Value = row.Value
+		tp.Status = TS_FINISHED
+		tp.ScheduledFor = row.Date
+		tp.ActualDate = row.Date
+		tp.Memo = row.Desc
+		tr.Parts = append(tr.Parts, *tp)
+		total += row.Value
+		if tr.RefTimeSpan.Start.IsZero() || row.Date.Before(tr.RefTimeSpan.Start) {
+			tr.RefTimeSpan.Start = row.Date
+		}
+		if row.Date.After(tr.RefTimeSpan.End) {
+			tr.RefTimeSpan.End = row.Date
+		}
+	}
+	tr.RefTimeSpan.End = EndOfDay(tr.RefTimeSpan.End)
+	fmt.Printf("%s %d parts on %s totaling %s %s", Bold("Preview:"), len(tr.Parts), cp.AccountId, fmt_decimal(total, ak.DecimalPlaces), ak.Id)
+	if invalid > 0 {
+		fmt.Printf(" (%s)", Red(fmt.Sprintf("%d invalid rows will be skipped", invalid)))
+	}
+	fmt.Println()
+	if dry_run || len(tr.Parts) == 0 {
+		return
+	}
+
+	flag := ToBool(ask_user(
+		LocalLine,
+		Sprintf(Bold("Save transaction? [y/n] ")),
+		"",
+		nil,
+		IsBool))
+	if !flag {
+		fmt.Println(Bold("Import avoided"))
+		return
+	}
+	tr.Name = ask_user(
+		LocalLine,
+		Sprintf(Bold("Name: ")),
+		"Import "+filepath.Base(line[1]),
+		nil,
+		True)
+	tr.Desc = fmt.Sprintf("Imported from %s with CSV profile %s", filepath.Base(line[1]), cp.Id)
+	add_counter_parts(tr, ask_counter_account())
+	err = tr.Save()
+	if err != nil {
+		print_err(err.Error())
+		return
+	}
+	fmt.Println(Bold("Id:"), tr.Id)
+}
+
+// Asks for the account on the other side of imported parts. Only strict mode requires one.
+func ask_counter_account() string {
+	def := ""
+	if StrictDoubleEntry {
+		def = EQUITY_ACCOUNT_ID
+	}
+	return ask_user(
+		LocalLine,
+		Sprintf(Bold("Counter account: ")),
+		def,
+		CompleterAccount,
+		func(s string) bool { return (s == "" && !StrictDoubleEntry) || IsAccount(s) })
+}
+
+// Balances each part of the transaction with an opposite one on acc_id, on the same dates
+func add_counter_parts(tr *Transaction, acc_id string) {
+	if acc_id == "" {
+		return
+	}
+	for _, tp := range tr.Parts {
+		counter := NewTransactionPart()
+		counter.TransactionId = tr.Id
+		counter.AccountId = acc_id
+		counter.AssetKindId = tp.AssetKindId
+		counter.Value = -tp.Value
+		counter.Status = tp.Status
+		counter.ScheduledFor = tp.ScheduledFor
+		counter.ActualDate = tp.ActualDate
+		counter.Memo = tp.Memo
+		tr.Parts = append(tr.Parts, *counter)
+	}
+}
+
+func csv_profile_ask(cp *CsvProfile) {
+	cp.Delimiter = ask_user(
+		LocalLine,
+		Sprintf(Bold("    Delimiter: ")),
+		cp.Delimiter,
+		readline.NewPrefixCompleter(readline.PcItem(","), readline.PcItem(";"), readline.PcItem("tab")),
+		func(s string) bool { return len([]rune(s)) == 1 || s == "tab" || s == "\\t" })
+	cp.HeaderRows = str.ToIntOr(ask_user(
+		LocalLine,
+		Sprintf(Bold("  Header rows: ")),
+		Sprintf(cp.HeaderRows),
+		nil,
+		IsInt), 0)
+	cp.DateColumn = ask_user(
+		LocalLine,
+		Sprintf(Bold("  Date column: ")),
+		cp.DateColumn,
+		nil,
+		func(s string) bool { return s != "" })
+	cp.DateFormat = ask_user(
+		LocalLine,
+		Sprintf(Bold("  Date format: ")),
+		cp.DateFormat,
+		readline.NewPrefixCompleter(readline.PcItem("DD/MM/YYYY"), readline.PcItem("MM/DD/YYYY"), readline.PcItem("YYYY-MM-DD")),
+		func(s string) bool { return s != "" })
+	cp.AmountColumn = ask_user(
+		LocalLine,
+		Sprintf(Bold("Amount column: ")),
+		cp.AmountColumn,
+		nil,
+		func(s string) bool { return s != "" })
+	cp.DecimalSep = ask_user(
+		LocalLine,
+		Sprintf(Bold("  Decimal sep: ")),
+		cp.DecimalSep,
+		readline.NewPrefixCompleter(readline.PcItem("."), readline.PcItem(",")),
+		func(s string) bool { return s == "." || s == "," })
+	cp.DescColumn = ask_user(
+		LocalLine,
+		Sprintf(Bold("  Desc column: ")),
+		cp.DescColumn,
+		nil,
+		True)
+	cp.AccountId = ask_user(
+		LocalLine,
+		Sprintf(Bold("    AccountId: ")),
+		cp.AccountId,
+		CompleterAccount,
+		IsAccount)
+	cp.AssetKindId = ask_user(
+		LocalLine,
+		Sprintf(Bold("  AssetKindId: ")),
+		cp.AssetKindId,
+		CompleterAssetKind,
+		IsAssetKind)
+}
+
+func csv_profile_show(line []string) {
+	cp := NewCsvProfile()
+	if len(line) > 0 {
+		err := cp.Load(line[0])
+		if err != nil {
+			print_err(err.Error())
+			return
+		}
+		fmt.Printf(cp.MultilineString())
+		return
+	}
+	for _, id := range load_ids("CsvProfile") {
+		err := cp.Load(id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(cp.ANSIString())
+	}
+}
+
+func csv_profile_add(line []string) {
+	cp := NewCsvProfile()
+	cp.Id = ask_user(
+		LocalLine,
+		Sprintf(Bold("           Id: ")),
+		"",
+		nil,
+		True)
+	csv_profile_ask(cp)
+	err := cp.Save()
+	if err != nil {
+		print_err(err.Error())
+	}
+}
+
+func csv_profile_edit(line []string) {
+	if len(line) == 0 {
+		print_err(Red("No id specified"))
+		return
+	}
+	cp := NewCsvProfile()
+	err := cp.Load(line[len(line)-1])
+	if err != nil {
+		print_err(err.Error())
+		return
+	}
+	fmt.Println(Bold("           Id:"), cp.Id, Gray("(non editable)"))
+	csv_profile_ask(cp)
+	err = cp.Update()
+	if err != nil {
+		print_err(err.Error())
+	}
+}
+
+func csv_profile_del(line []string) {
+	if len(line) == 0 {
+		print_err(Red("No id specified"))
+		return
+	}
+	id := line[len(line)-1]
+	deleter(id, NewCsvProfile())
+}
+
+func CompleteCsvProfileFunc(prefix string) []string {
+	tmp := strings.Split(prefix, " ")
+	spec := tmp[len(tmp)-1]
+	found := make([]string, 0)
+	for _, id := range load_ids("CsvProfile") {
+		if strings.HasPrefix(id, spec) {
+			found = append(found, id)
+		}
+	}
+	return found
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	. "github.com/logrusorgru/aurora"
+)
+
+// Bump whenever the layout of LedgerJSON changes in an incompatible way
+const JSON_FORMAT_VERSION = 1
+
+// Everything in the database but the settings. Tags travel inside each object.
+type LedgerJSON struct {
+	Version              int
+	Accounts             []Account
+	AssetKinds           []AssetKind
+	AssetValues          []AssetValue
+	Transactions         []Transaction
+	Reconciliations      []Reconciliation
+	Recurring            []Recurring
+	RecurringOccurrences []RecurringOccurrence
+	Budgets              []Budget
+	CsvProfiles          []CsvProfile
+}
+
+// Tables wiped by 'import json <file> replace'
+var LedgerTables = []string{"TransactionItem", "TransactionPart", "Transaction", "Reconciliation", "AssetValue", "AssetKind", "Account", "Tags",
+	"Recurring", "RecurringOccurrence", "Budget", "CsvProfile"}
+
+func load_ids(table string) []string {
+	rows, err := DB.Query(fmt.Sprintf("SELECT `Id` FROM `%s` ORDER BY `Id`", table))
+	if err != nil {
+		log.Fatal(err)
+	}
+	ids := make([]string, 0)
+	defer rows.Close()
+	for rows.Next() {
+		id := ""
+		err := rows.Scan(&id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func load_ledger() (LedgerJSON, error) {
+	ledger := LedgerJSON{Version: JSON_FORMAT_VERSION}
+	for _, id := range load_ids("Account") {
+		acc := Account{}
+		err := acc.Load(id)
+		if err != nil {
+			return ledger, err
+		}
+		ledger.Accounts = append(ledger.Accounts, acc)
+	}
+	for _, id := range load_ids("AssetKind") {
+		ak := AssetKind{}
+		err := ak.Load(id)
+		if err != nil {
+			return ledger, err
+		}
+		ledger.AssetKinds = append(ledger.AssetKinds, ak)
+	}
+	for _, id := range load_ids("AssetValue") {
+		av := AssetValue{}
+		err := av.Load(id)
+		if err != nil {
+			return ledger, err
+		}
+		ledger.AssetValues = append(ledger.AssetValues, av)
+	}
+	for _, id := range load_ids("Transaction") {
+		tr := Transaction{}
+		err := tr.Load(id)
+		if err != nil {
+			return ledger, err
+		}
+		ledger.Transactions = append(ledger.Transactions, tr)
+	}
+	for _, id := range load_ids("Reconciliation") {
+		rc := Reconciliation{}
+		err := rc.Load(id)
+		if err != nil {
+			return ledger, err
+		}
+		ledger.Reconciliations = append(ledger.Reconciliations, rc)
+	}
+	ledger.Recurring = load_recurring()
+	ledger.RecurringOccurrences = load_occurrences()
+	ledger.Budgets = load_budgets("")
+	for _, id := range load_ids("CsvProfile") {
+		cp := CsvProfile{}
+		err := cp.Load(id)
+		if err != nil {
+			return ledger, err
+		}
+		ledger.CsvProfiles = append(ledger.CsvProfiles, cp)
+	}
+	return ledger, nil
+}
+
+// Usage: export json <file>
+func export_json(line []string) {
+	if len(line) != 1 {
+		print_err(Red("Usage: export json <file>"))
+		return
+	}
+	ledger, err := load_ledger()
+	if err != nil {
+		print_err(err.Error())
+		return
+	}
+	err = jsonToFile(line[0], ledger)
+	if err != nil {
+		print_err(err.Error())
+		return
+	}
+	fmt.Printf("%s %d accounts, %d asset kinds, %d asset values, %d transactions, %d recurring transactions and %d budgets to %s\n",
+		Bold("Exported"), len(ledger.Accounts), len(ledger.AssetKinds), len(ledger.AssetValues), len(ledger.Transactions), len(ledger.Recurring), len(ledger.Budgets), line[0])
+}
+
+var ImportAbortedErr = errors.New("Import aborted")
+
+const (
+	IMPORT_ADD = iota
+	IMPORT_OVERWRITE
+	IMPORT_SKIP
+)
+
+// One object of the file along with how to compare, delete and save it
+type importObject struct {
+	Table    string
+	Id       string
+	Obj      interface{}
+	Existing func() (interface{}, error) // Loads the version already in the database
+	Del      func(q Querier) error
+	Save     func(q Querier) error
+	Action   int
+	Clash    func() string // Optional, describes ids used by other objects (which cannot be overwritten)
+}
+
+// Parts and items are loaded in no particular order
+func sort_children(tr *Transaction) {
+	sort.Slice(tr.Parts, func(i, j int) bool { return tr.Parts[i].Id < tr.Parts[j].Id })
+	sort.Slice(tr.Items, func(i, j int) bool { return tr.Items[i].Id < tr.Items[j].Id })
+}
+
+// Lists the parts and items of tr whose ids belong to other transactions
+func transaction_clashes(tr Transaction) string {
+	clashes := make([]string, 0)
+	check := func(table, id string) {
+		owner := ""
+		err := DB.QueryRow(fmt.Sprintf("SELECT `TransactionId` FROM `%s` WHERE `Id` = ?", table), id).Scan(&owner)
+		if err == nil && owner != tr.Id {
+			clashes = append(clashes, fmt.Sprintf("%s %s belongs to transaction %s", table, id, owner))
+		} else if err != nil && err != sql.ErrNoRows {
+			log.Fatal(err)
+		}
+	}
+	for _, tp := range tr.Parts {
+		check("TransactionPart", tp.Id)
+	}
+	for _, ti := range tr.Items {
+		check("TransactionItem", ti.Id)
+	}
+	return strings.Join(clashes, ", ")
+}
+
+func import_objects(ledger LedgerJSON) []importObject {
+	objs := make([]importObject, 0)
+	for _, acc := range ledger.Accounts {
+		acc := acc
+		acc.Init()
+		objs = append(objs, importObject{acc.TypeName(), acc.Id, acc,
+			func() (interface{}, error) { old := Account{}; err := old.Load(acc.Id); return old, err },
+			func(q Querier) error { return acc.DelWith(q, acc.Id) },
+			acc.SaveWith, IMPORT_ADD, nil})
+	}
+	for _, ak := range ledger.AssetKinds {
+		ak := ak
+		ak.Init()
+		objs = append(objs, importObject{ak.TypeName(), ak.Id, ak,
+			func() (interface{}, error) { old := AssetKind{}; err := old.Load(ak.Id); return old, err },
+			func(q Querier) error { return ak.DelWith(q, ak.Id) },
+			ak.SaveWith, IMPORT_ADD, nil})
+	}
+	for _, av := range ledger.AssetValues {
+		av := av
+		av.Init()
+		objs = append(objs, importObject{av.TypeName(), av.Id, av,
+			func() (interface{}, error) { old := AssetValue{}; err := old.Load(av.Id); return old, err },
+			func(q Querier) error { return av.DelWith(q, av.Id) },
+			av.SaveWith, IMPORT_ADD, nil})
+	}
+	for _, tr := range ledger.Transactions {
+		tr := tr
+		tr.Init()
+		for i := range tr.Parts {
+			tr.Parts[i].TransactionId = tr.Id
+			tr.Parts[i].Init()
+		}
+		for i := range tr.Items {
+			tr.Items[i].TransactionId = tr.Id
+			tr.Items[i].Init()
+		}
+		sort_children(&tr)
+		objs = append(objs, importObject{tr.TypeName(), tr.Id, tr,
+			func() (interface{}, error) {
+				old := Transaction{}
+				err := old.Load(tr.Id)
+				sort_children(&old)
+				return old, err
+			},
+			func(q Querier) error {
+				// The parts in the file replace the reconciled ones, along with their own reconciliation ids
+				_, err := q.Exec("UPDATE `TransactionPart` SET `ReconciliationId` = '' WHERE `TransactionId` = ?", tr.Id)
+				if err != nil {
+					return err
+				}
+				return tr.DelWith(q, tr.Id)
+			},
+			tr.SaveWith, IMPORT_ADD,
+			func() string { return transaction_clashes(tr) }})
+	}
+	for _, rc := range ledger.Reconciliations {
+		rc := rc
+		rc.Init()
+		objs = append(objs, importObject{rc.TypeName(), rc.Id, rc,
+			func() (interface{}, error) { old := Reconciliation{}; err := old.Load(rc.Id); return old, err },
+			// Only the row itself, the parts keep pointing to it
+			func(q Querier) error {
+				_, err := q.Exec("DELETE FROM `Reconciliation` WHERE `Id` = ?", rc.Id)
+				return err
+			},
+			rc.SaveWith, IMPORT_ADD, nil})
+	}
+	for _, rec := range ledger.Recurring {
+		rec := rec
+		rec.Template.Init()
+		objs = append(objs, importObject{rec.TypeName(), rec.Id, rec,
+			func() (interface{}, error) { old := Recurring{}; err := old.Load(rec.Id); return old, err },
+			// Only the row itself, its occurrences are imported on their own
+			func(q Querier) error {
+				_, err := q.Exec("DELETE FROM `Recurring` WHERE `Id` = ?", rec.Id)
+				return err
+			},
+			rec.SaveWith, IMPORT_ADD, nil})
+	}
+	for _, occ := range ledger.RecurringOccurrences {
+		occ := occ
+		objs = append(objs, importObject{"RecurringOccurrence", occ.Key(), occ,
+			func() (interface{}, error) {
+				old := RecurringOccurrence{}
+				err := old.Load(occ.RecurringId, occ.Date)
+				return old, err
+			},
+			occ.DelWith, occ.SaveWith, IMPORT_ADD, nil})
+	}
+	for _, b := range ledger.Budgets {
+		b := b
+		b.Init()
+		objs = append(objs, importObject{b.TypeName(), b.Id, b,
+			func() (interface{}, error) { old := Budget{}; err := old.Load(b.Id); return old, err },
+			func(q Querier) error { return b.DelWith(q, b.Id) },
+			b.SaveWith, IMPORT_ADD, nil})
+	}
+	for _, cp := range ledger.CsvProfiles {
+		cp := cp
+		objs = append(objs, importObject{cp.TypeName(), cp.Id, cp,
+			func() (interface{}, error) { old := CsvProfile{}; err := old.Load(cp.Id); return old, err },
+			func(q Querier) error { return cp.DelWith(q, cp.Id) },
+			cp.SaveWith, IMPORT_ADD, nil})
+	}
+	return objs
+}
+
+// Looks for ids already in use and asks what to do with each of them.
+// Objects identical to the ones in the database are silently skipped so importing the same file twice is a no-op.
+func resolve_conflicts(objs []importObject) error {
+	for i, obj := range objs {
+		if obj.Clash != nil {
+			if clash := obj.Clash(); clash != "" {
+				fmt.Println(Bold(Yellow(fmt.Sprintf("%s %s cannot be imported: %s", obj.Table, obj.Id, clash))))
+				choice := ask_user_key(
+					"clashes",
+					LocalLine,
+					Sprintf(Bold("[s]kip or [a]bort? ")),
+					"s",
+					nil,
+					func(s string) bool { return s == "s" || s == "a" })
+				if choice == "a" {
+					return ImportAbortedErr
+				}
+				objs[i].Action = IMPORT_SKIP
+				continue
+			}
+		}
+		old, err := obj.Existing()
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if same_json(old, obj.Obj) {
+			objs[i].Action = IMPORT_SKIP
+			continue
+		}
+		fmt.Println(Bold(Yellow(fmt.Sprintf("%s %s already exists with different data", obj.Table, obj.Id))))
+		choice := ask_user_key(
+			"conflicts",
+			LocalLine,
+			Sprintf(Bold("[s]kip, [o]verwrite or [a]bort? ")),
+			"s",
+			nil,
+			func(s string) bool { return s == "s" || s == "o" || s == "a" })
+		switch choice {
+		case "s":
+			objs[i].Action = IMPORT_SKIP
+		case "o":
+			objs[i].Action = IMPORT_OVERWRITE
+		case "a":
+			return ImportAbortedErr
+		}
+	}
+	return nil
+}
+
+func same_json(a, b interface{}) bool {
+	dat_a, err_a := json.Marshal(a)
+	dat_b, err_b := json.Marshal(b)
+	return err_a == nil && err_b == nil && string(dat_a) == string(dat_b)
+}
+
+// Usage: import json <file> [merge|replace]
+func import_json(line []string) {
+	usage := "Usage: import json <file> [merge|replace]"
+	if len(line) < 1 || len(line) > 2 {
+		print_err(Red(usage))
+		return
+	}
+	mode := "merge"
+	if len(line) == 2 {
+		mode = line[1]
+	}
+	if mode != "merge" && mode != "replace" {
+		print_err(Red(usage))
+		return
+	}
+
+	ledger := LedgerJSON{}
+	err := jsonFromFile(line[0], &ledger)
+	if err != nil {
+		print_err(err.Error())
+		return
+	}
+	if ledger.Version < 1 || ledger.Version > JSON_FORMAT_VERSION {
+		print_err(Red(fmt.Sprintf("Unsupported file version %d (this wedge reads up to %d)", ledger.Version, JSON_FORMAT_VERSION)))
+		return
+	}
+
+	if mode == "replace" {
+		conf := "REPLACE"
+		if Interactive {
+			fmt.Printf("This deletes everything in %s. Type '%s' to confirm: ", DBFilename, Bold(Red(conf)))
+		}
+		input := ask_user_key(
+			"confirm",
+			LocalLine,
+			fmt.Sprintf("This deletes everything in %s. Type '%s' to confirm: ", DBFilename, Bold(Red(conf))),
+			"",
+			nil,
+			True)
+		if input != conf {
+			fmt.Println(Bold("Import avoided"))
+			return
+		}
+	}
+
+	objs := import_objects(ledger)
+	if mode == "merge" {
+		err = resolve_conflicts(objs)
+		if err != nil {
+			print_err(Red(err.Error()))
+			return
+		}
+	}
+
+	counts := make(map[int]int)
+	err = WithTx(func(q Querier) error {
+		if mode == "replace" {
+			for _, table := range LedgerTables {
+				_, err := q.Exec(fmt.Sprintf("DELETE FROM `%s`", table))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		for _, obj := range objs {
+			counts[obj.Action]++
+			if obj.Action == IMPORT_SKIP {
+				continue
+			}
+			if obj.Action == IMPORT_OVERWRITE {
+				err := obj.Del(q)
+				if err != nil {
+					return err
+				}
+			}
+			err := obj.Save(q)
+			if err != nil {
+				return fmt.Errorf("%s %s: %s", obj.Table, obj.Id, err.Error())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		print_err(Red(err.Error()))
+		return
+	}
+	fmt.Printf("%s %d added, %d overwritten, %d skipped\n", Bold("Import done:"), counts[IMPORT_ADD], counts[IMPORT_OVERWRITE], counts[IMPORT_SKIP])
+}
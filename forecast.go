@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/logrusorgru/aurora"
+)
+
+// The balance of one asset at the end of a day
+type ForecastDay struct {
+	Day     string
+	Change  int
+	Balance int
+}
+
+// Sums, per asset and day, the parts expected to happen but not cleared yet of the given accounts up to the end date
+func load_pending_changes(acc_ids map[string]bool, end time.Time) map[string]map[string]int {
+	query := "SELECT `AccountId`, `AssetKindId`, `ScheduledFor`, `Value` FROM `TransactionPart` WHERE `Status` IN (?, ?, ?) AND `ScheduledFor` <= ?"
+	rows, err := DB.Query(query, TS_SCHEDULED, TS_PLANNED, TS_ON_GOING, end.Unix())
+	if err != nil {
+		log.Fatal(err)
+	}
+	ans := make(map[string]map[string]int)
+	defer rows.Close()
+	for rows.Next() {
+		var acc_id, asset_id string
+		var date int64
+		var val int
+		err := rows.Scan(&acc_id, &asset_id, &date, &val)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !acc_ids[acc_id] {
+			continue
+		}
+		if ans[asset_id] == nil {
+			ans[asset_id] = make(map[string]int)
+		}
+		ans[asset_id][time.Unix(date, 0).Format(DAY_FMT)] += val
+	}
+	return ans
+}
+
+// Usage: forecast <account> <period>
+// Starts from today's cleared balance (of the account and its children) and applies the scheduled, planned and on going parts in date order.
+// Parts due before the first day of the forecast are taken as still expected and applied on it. Days without movements are left out.
+func forecast(line []string) {
+	usage := "Usage: forecast <account> <period>"
+	if len(line) < 2 || len(line) > 3 {
+		print_err(Red(usage))
+		return
+	}
+	acc_id := line[0]
+	if !IsAccount(acc_id) {
+		print_err(Red("No such account: " + acc_id))
+		return
+	}
+	period, err := ParseTimePeriod(strings.Join(line[1:], " "))
+	if err != nil {
+		print_err(err.Error())
+		return
+	}
+	now := time.Now()
+	if period.End.Before(now) {
+		print_err(Red("The period is already over"))
+		return
+	}
+	first_day := now.Format(DAY_FMT)
+	if period.Start.After(now) {
+		first_day = period.Start.Format(DAY_FMT)
+	}
+
+	accs := load_accounts()
+	kinds := load_asset_kinds()
+	subtree := account_subtree(accs, acc_id)
+	opening := rollup_balances(accs, load_direct_balances(ClearedFilter(now)))[acc_id]
+	changes := load_pending_changes(subtree, period.End)
+	// Every asset with either a balance or something pending
+	assets := make(Balance)
+	assets.Add(opening)
+	for asset_id := range changes {
+		assets[asset_id] = opening[asset_id]
+	}
+
+	fmt.Printf("%s %s %s\n", Bold("Forecast for"), Bold(acc_id), Gray(first_day+" → "+period.End.Format(DAY_FMT)))
+	for _, asset_id := range assets.AssetIds() {
+		days := forecast_days(opening[asset_id], changes[asset_id], first_day)
+		forecast_print(asset_id, kinds[asset_id].DecimalPlaces, days)
+	}
+}
+
+// Running balance of one asset. The first day also gets everything due before it.
+func forecast_days(opening int, changes map[string]int, first_day string) []ForecastDay {
+	dates := make([]string, 0, len(changes))
+	for day := range changes {
+		dates = append(dates, day)
+	}
+	sort.Strings(dates)
+	ans := []ForecastDay{{Day: first_day, Balance: opening}}
+	for _, day := range dates {
+		cur := &ans[len(ans)-1]
+		if day > cur.Day {
+			ans = append(ans, ForecastDay{Day: day, Balance: cur.Balance})
+			cur = &ans[len(ans)-1]
+		}
+		cur.Change += changes[day]
+		cur.Balance += changes[day]
+	}
+	return ans
+}
+
+func forecast_print(asset_id string, places int, days []ForecastDay) {
+	lowest := 0
+	for i, fd := range days {
+		if fd.Balance < days[lowest].Balance {
+			lowest = i
+		}
+	}
+	fmt.Println(Bold(asset_id))
+	// Stretches of days below zero
+	negative := make([]string, 0)
+	for i, fd := range days {
+		change := ""
+		if fd.Change != 0 {
+			change = fmt_decimal_pad(fd.Change, places, 10)
+		}
+		bal := fmt_decimal_pad(fd.Balance, places, 10)
+		if fd.Balance < 0 {
+			bal = Sprintf(Bold(Red(bal)))
+			if i == 0 || days[i-1].Balance >= 0 {
+				negative = append(negative, fd.Day+" → ")
+			}
+		} else {
+			bal = Sprintf(Cyan(bal))
+			if i > 0 && days[i-1].Balance < 0 {
+				negative[len(negative)-1] += fd.Day
+			}
+		}
+		mark := ""
+		if i == lowest {
+			mark = Sprintf(Yellow(" ◀ lowest"))
+		}
+		fmt.Printf("  %s %*s %s%s\n", fd.Day, 10+places+1, change, bal, mark)
+	}
+	if len(negative) > 0 {
+		if days[len(days)-1].Balance < 0 {
+			negative[len(negative)-1] += "end"
+		}
+		fmt.Println(Bold(Red("  Below zero: " + strings.Join(negative, ", "))))
+	}
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
+	"log"
 
 	. "github.com/logrusorgru/aurora"
 )
@@ -12,12 +15,176 @@ type ILoadable interface {
 
 type IDeletable interface {
 	Del(id string) error
+	DelWith(q Querier, id string) error
+}
+
+// Implemented by both *sql.DB and *sql.Tx so the data layer can run either directly or as part of a bigger atomic operation
+type Querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Runs fn inside a single SQL transaction. Everything is rolled back if fn fails.
+func WithTx(fn func(q Querier) error) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Objects that other rows may reference (see CheckedRefs)
+type ITyped interface {
+	TypeName() string
+}
+
+// A set of rows referencing some object through Column
+type Dependents struct {
+	Table  string
+	Column string
+	Count  int
+}
+
+func count_dependents(table, id string) []Dependents {
+	ans := make([]Dependents, 0)
+	for _, ref := range CheckedRefs {
+		if ref.TargetTable != table || ref.Owned {
+			continue
+		}
+		dep := Dependents{Table: ref.Table, Column: ref.Column}
+		err := DB.QueryRow(fmt.Sprintf("SELECT COUNT() FROM `%s` WHERE `%s` = ? AND `Id` != ?", ref.Table, ref.Column), id, id).
+			Scan(&dep.Count)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if dep.Count > 0 {
+			ans = append(ans, dep)
+		}
+	}
+	return ans
+}
+
+// Points every row referencing id to new_id instead
+func reassign_dependents(q Querier, table, id, new_id string) error {
+	for _, ref := range CheckedRefs {
+		if ref.TargetTable != table || ref.Owned {
+			continue
+		}
+		_, err := q.Exec(fmt.Sprintf("UPDATE `%s` SET `%s` = ? WHERE `%s` = ?", ref.Table, ref.Column, ref.Column), new_id, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deletes every row that references id, recursively (e.g. child accounts and their parts)
+func cascade_dependents(q Querier, table, id string, visited map[string]bool) error {
+	if visited[table+"\x00"+id] {
+		return nil
+	}
+	visited[table+"\x00"+id] = true
+	for _, ref := range CheckedRefs {
+		if ref.TargetTable != table || ref.Owned {
+			continue
+		}
+		rows, err := q.Query(fmt.Sprintf("SELECT `Id` FROM `%s` WHERE `%s` = ? AND `Id` != ?", ref.Table, ref.Column), id, id)
+		if err != nil {
+			return err
+		}
+		ids := make([]string, 0)
+		for rows.Next() {
+			dep_id := ""
+			err := rows.Scan(&dep_id)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, dep_id)
+		}
+		rows.Close()
+		for _, dep_id := range ids {
+			if ref.Table == "TransactionPart" {
+				// Removing single parts would leave their transactions unbalanced
+				if StrictDoubleEntry {
+					return errors.New("Cascading would delete parts of balanced transactions (strict mode is on), reassign them instead")
+				}
+				err = check_unreconciled(q, "`Id` = ?", dep_id)
+				if err != nil {
+					return err
+				}
+			}
+			err = cascade_dependents(q, ref.Table, dep_id, visited)
+			if err != nil {
+				return err
+			}
+			_, err = q.Exec(fmt.Sprintf("DELETE FROM `%s` WHERE `Id` = ?", ref.Table), dep_id)
+			if err != nil {
+				return err
+			}
+			err = del_tags(q, ref.Table, dep_id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func deleter(id string, obj IDeletable) {
+	// Deal with anything that references the object
+	resolve := func(q Querier) error { return nil }
+	if typed, ok := obj.(ITyped); ok {
+		table := typed.TypeName()
+		deps := count_dependents(table, id)
+		if len(deps) > 0 {
+			fmt.Println(Bold(Yellow(fmt.Sprintf("%s %s is still referenced by:", table, id))))
+			for _, dep := range deps {
+				fmt.Printf("  %d %s row(s) via %s\n", dep.Count, Bold(dep.Table), dep.Column)
+			}
+			choice := ask_user_key(
+				"dependents",
+				LocalLine,
+				Sprintf(Bold("[a]bort, [r]eassign them or [c]ascade delete? ")),
+				"a",
+				nil,
+				func(s string) bool { return s == "a" || s == "r" || s == "c" })
+			switch choice {
+			case "a":
+				fmt.Println(Bold("Deletion avoided"))
+				return
+			case "r":
+				new_id := ask_user(
+					LocalLine,
+					Sprintf(Bold("Reassign to: ")),
+					"",
+					completer_for(table),
+					func(s string) bool {
+						// Children of a deleted account cannot be moved under its own descendants
+						if table == "Account" && account_subtree(load_accounts(), id)[s] {
+							return false
+						}
+						return s != id && exists_in(table)(s)
+					})
+				resolve = func(q Querier) error { return reassign_dependents(q, table, id, new_id) }
+			case "c":
+				resolve = func(q Querier) error { return cascade_dependents(q, table, id, make(map[string]bool)) }
+			}
+		}
+	}
+
 	conf := "DEL-" + id
-	fmt.Printf("Type '%s' to confirm deletion: ", Bold(Red(conf)))
-	input := ask_user(
+	if Interactive {
+		fmt.Printf("Type '%s' to confirm deletion: ", Bold(Red(conf)))
+	}
+	input := ask_user_key(
+		"confirm",
 		LocalLine,
 		fmt.Sprintf("Type '%s' to confirm deletion: ", Bold(Red(conf))),
 		"",
@@ -27,9 +194,16 @@ func deleter(id string, obj IDeletable) {
 		fmt.Println(Bold("Deletion avoided"))
 		return
 	}
-	err := obj.Del(id)
+	// Dependents and the object itself go away together or not at all
+	err := WithTx(func(q Querier) error {
+		err := resolve(q)
+		if err != nil {
+			return err
+		}
+		return obj.DelWith(q, id)
+	})
 	if err != nil {
-		fmt.Println(err.Error())
+		print_err(err.Error())
 		return
 	}
 	fmt.Println(Bold("Deletion done"))
@@ -0,0 +1,805 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	. "github.com/logrusorgru/aurora"
+)
+
+// Ledger/hledger journals. Accounts are written as the colon separated ids of their ancestors
+// and statuses map to the cleared (*) and pending (!) markers, planned parts being unmarked.
+
+func ledger_mark(status string) string {
+	switch status {
+	case TS_FINISHED:
+		return "*"
+	case TS_SCHEDULED, TS_ON_GOING:
+		return "!"
+	}
+	return ""
+}
+
+func ledger_status(mark string, date time.Time) string {
+	switch mark {
+	case "*":
+		return TS_FINISHED
+	case "!":
+		if date.After(time.Now()) {
+			return TS_SCHEDULED
+		}
+		return TS_ON_GOING
+	}
+	return TS_PLANNED
+}
+
+// Commodities that are not only letters must be quoted
+func ledger_commodity(id string) string {
+	for _, r := range id {
+		if !unicode.IsLetter(r) {
+			return fmt.Sprintf("%q", id)
+		}
+	}
+	return id
+}
+
+func ledger_amount(raw, decimal_places int, commodity string) string {
+	return fmt_decimal(raw, decimal_places) + " " + ledger_commodity(commodity)
+}
+
+// Maps account ids to their full colon separated names
+func ledger_account_names(accs []Account) map[string]string {
+	parents := make(map[string]string)
+	for _, acc := range accs {
+		parents[acc.Id] = acc.ParentId
+	}
+	names := make(map[string]string)
+	for _, acc := range accs {
+		path := []string{acc.Id}
+		seen := map[string]bool{acc.Id: true}
+		for cur := parents[acc.Id]; cur != "" && !seen[cur]; cur = parents[cur] {
+			path = append([]string{cur}, path...)
+			seen[cur] = true
+		}
+		names[acc.Id] = strings.Join(path, ":")
+	}
+	return names
+}
+
+func ledger_tags(tags map[string]bool) string {
+	return ":" + strings.Join(tags_list(tags), ":") + ":"
+}
+
+// Usage: export ledger <file>
+func export_ledger(line []string) {
+	if len(line) != 1 {
+		print_err(Red("Usage: export ledger <file>"))
+		return
+	}
+	ledger, err := load_ledger()
+	if err != nil {
+		print_err(err.Error())
+		return
+	}
+	kinds := make(map[string]AssetKind)
+	for _, ak := range ledger.AssetKinds {
+		kinds[ak.Id] = ak
+	}
+	names := ledger_account_names(ledger.Accounts)
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "; Exported by wedge from %s\n\n", DBFilename)
+	for _, ak := range ledger.AssetKinds {
+		fmt.Fprintf(b, "commodity %s\n", ledger_commodity(ak.Id))
+		fmt.Fprintf(b, "    note %s\n", ak.Name)
+		fmt.Fprintf(b, "    format %s\n", ledger_amount(1000*int(math.Pow10(ak.DecimalPlaces)), ak.DecimalPlaces, ak.Id))
+	}
+	b.WriteString("\n")
+	for _, acc := range ledger.Accounts {
+		fmt.Fprintf(b, "account %s\n", names[acc.Id])
+		fmt.Fprintf(b, "    note %s\n", acc.Name)
+	}
+	b.WriteString("\n")
+	for _, av := range ledger.AssetValues {
+		fmt.Fprintf(b, "P %s %s %s\n", av.Date.Format(DAY_FMT), ledger_commodity(av.AssetId), ledger_amount(av.Value, kinds[av.RefId].DecimalPlaces, av.RefId))
+	}
+
+	// Transactions are dated after their earliest part
+	sort.SliceStable(ledger.Transactions, func(i, j int) bool {
+		return ledger_entry_date(ledger.Transactions[i]).Before(ledger_entry_date(ledger.Transactions[j]))
+	})
+	canceled := 0
+	for _, tr := range ledger.Transactions {
+		parts := make([]TransactionPart, 0)
+		for _, tp := range tr.Parts {
+			if tp.Status == TS_CANCELED {
+				canceled++
+				continue
+			}
+			parts = append(parts, tp)
+		}
+		if len(parts) == 0 {
+			continue
+		}
+		date := ledger_entry_date(tr)
+		// A single marker for the whole entry when all parts agree
+		mark := ledger_mark(parts[0].Status)
+		for _, tp := range parts {
+			if ledger_mark(tp.Status) != mark {
+				mark = ""
+			}
+		}
+		header := date.Format(DAY_FMT)
+		if mark != "" {
+			header += " " + mark
+		}
+		fmt.Fprintf(b, "\n%s %s\n", header, tr.Name)
+		if tr.Desc != "" {
+			fmt.Fprintf(b, "    ; %s\n", tr.Desc)
+		}
+		if len(tags_list(tr.Tags)) > 0 {
+			fmt.Fprintf(b, "    ; %s\n", ledger_tags(tr.Tags))
+		}
+		for _, tp := range parts {
+			posting := names[tp.AccountId]
+			if posting == "" {
+				posting = tp.AccountId
+			}
+			if mark == "" && ledger_mark(tp.Status) != "" {
+				posting = ledger_mark(tp.Status) + " " + posting
+			}
+			comment := make([]string, 0)
+			if tp.Memo != "" {
+				comment = append(comment, tp.Memo)
+			}
+			if tp_date := tp.EffectiveDate(); tp_date.Format(DAY_FMT) != date.Format(DAY_FMT) {
+				comment = append(comment, "["+tp_date.Format(DAY_FMT)+"]")
+			}
+			if len(tags_list(tp.Tags)) > 0 {
+				comment = append(comment, ledger_tags(tp.Tags))
+			}
+			fmt.Fprintf(b, "    %s  %s", posting, ledger_amount(tp.Value, kinds[tp.AssetKindId].DecimalPlaces, tp.AssetKindId))
+			if len(comment) > 0 {
+				fmt.Fprintf(b, "  ; %s", strings.Join(comment, " "))
+			}
+			b.WriteString("\n")
+		}
+	}
+
+	err = ioutil.WriteFile(line[0], []byte(b.String()), 0644)
+	if err != nil {
+		print_err(err.Error())
+		return
+	}
+	fmt.Printf("%s %d accounts, %d commodities, %d prices and %d transactions to %s\n",
+		Bold("Exported"), len(ledger.Accounts), len(ledger.AssetKinds), len(ledger.AssetValues), len(ledger.Transactions), line[0])
+	if canceled > 0 {
+		fmt.Println(Yellow(fmt.Sprintf("%d canceled parts were left out", canceled)))
+	}
+}
+
+func ledger_entry_date(tr Transaction) time.Time {
+	ans := time.Time{}
+	for _, tp := range tr.Parts {
+		if tp.Status == TS_CANCELED {
+			continue
+		}
+		if ans.IsZero() || tp.EffectiveDate().Before(ans) {
+			ans = tp.EffectiveDate()
+		}
+	}
+	if ans.IsZero() {
+		return tr.RefTimeSpan.Start
+	}
+	return ans
+}
+
+// Where the two sides of postings with a cost meet (e.g. "-10 AAPL @ 150 USD")
+const LEDGER_CONVERSION_ACCOUNT = "equity:conversion"
+
+// What was read from a journal, before being mapped to wedge objects
+type LedgerJournal struct {
+	Precision map[string]int    // Decimal places of each commodity
+	Notes     map[string]string // Descriptions of accounts and commodities
+	Accounts  []string          // Full names, in the order they were found
+	Prices    []LedgerPrice
+	Entries   []LedgerEntry
+}
+
+type LedgerPrice struct {
+	Date      time.Time
+	Commodity string
+	Amount    LedgerAmount
+}
+
+type LedgerEntry struct {
+	Line     int
+	Date     time.Time
+	Mark     string
+	Desc     string
+	Comments []string
+	Tags     map[string]bool
+	Postings []LedgerPosting
+}
+
+type LedgerPosting struct {
+	Account string
+	Mark    string
+	Date    time.Time // Zero when it is the same as the entry
+	Amount  LedgerAmount
+	Cost    LedgerAmount // Total cost from '@' or '@@', empty when there is none
+	Memo    string
+	Tags    map[string]bool
+}
+
+// Number is kept as text until the precision of the commodity is known. Empty when elided.
+type LedgerAmount struct {
+	Number    string
+	Commodity string
+}
+
+var ledger_number_re = regexp.MustCompile(`[0-9][0-9,]*(\.[0-9]*)?|\.[0-9]+`)
+var ledger_tags_re = regexp.MustCompile(`:(([^:\s]+:)+)`)
+var ledger_date_re = regexp.MustCompile(`\[=?([0-9]{4}[-/.][0-9]{1,2}[-/.][0-9]{1,2})\]|date:\s*([0-9]{4}[-/.][0-9]{1,2}[-/.][0-9]{1,2})`)
+
+func parse_ledger_date(s string) (time.Time, error) {
+	s = strings.NewReplacer("/", "-", ".", "-").Replace(s)
+	return time.Parse("2006-1-2", s)
+}
+
+// Reads "AMOUNT [@ UNIT COST | @@ TOTAL COST] [= ASSERTION]". Balance assertions are not kept.
+// The cost is returned as a total with the sign of the amount (e.g. "-10 AAPL @ 150 USD" costs -1500 USD).
+func parse_ledger_posting_amount(s string) (LedgerAmount, LedgerAmount, error) {
+	if i := strings.Index(s, "="); i >= 0 {
+		s = s[:i]
+	}
+	cost_str, total := "", false
+	if i := strings.Index(s, "@@"); i >= 0 {
+		s, cost_str, total = s[:i], s[i+2:], true
+	} else if i := strings.Index(s, "@"); i >= 0 {
+		s, cost_str = s[:i], s[i+1:]
+	}
+	amount, err := parse_ledger_amount(s)
+	if err != nil || cost_str == "" {
+		return amount, LedgerAmount{}, err
+	}
+	cost, err := parse_ledger_amount(cost_str)
+	if err != nil {
+		return amount, cost, err
+	}
+	if amount.Number == "" || cost.Number == "" {
+		return amount, cost, errors.New("cost without amount: " + s + "@" + cost_str)
+	}
+	num, ok1 := new(big.Rat).SetString(amount.Number)
+	price, ok2 := new(big.Rat).SetString(strings.TrimPrefix(cost.Number, "-"))
+	if !ok1 || !ok2 {
+		return amount, cost, errors.New("invalid cost: " + cost_str)
+	}
+	places := cost.DecimalPlaces()
+	if total && num.Sign() == 0 {
+		price.SetInt64(0)
+	} else if total {
+		price.Quo(price, new(big.Rat).Abs(num))
+	} else {
+		places += amount.DecimalPlaces()
+	}
+	cost.Number = new(big.Rat).Mul(num, price).FloatString(places)
+	return amount, cost, nil
+}
+
+func parse_ledger_amount(s string) (LedgerAmount, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return LedgerAmount{}, nil
+	}
+	// Quoted commodities may contain anything, including digits and dashes
+	commodity := ""
+	if i := strings.Index(s, "\""); i >= 0 {
+		if j := strings.Index(s[i+1:], "\""); j >= 0 {
+			commodity = s[i+1 : i+1+j]
+			s = s[:i] + " " + s[i+j+2:]
+		}
+	}
+	loc := ledger_number_re.FindStringIndex(s)
+	if loc == nil {
+		return LedgerAmount{}, errors.New("invalid amount: " + s)
+	}
+	number := strings.Replace(s[loc[0]:loc[1]], ",", "", -1)
+	// The sign is either right before the number ("$-10", "-10 USD") or before a prefix commodity ("-$10")
+	before, after := strings.TrimSpace(s[:loc[0]]), strings.TrimSpace(s[loc[1]:])
+	if strings.HasSuffix(before, "-") {
+		number = "-" + number
+		before = strings.TrimSpace(strings.TrimSuffix(before, "-"))
+	} else if strings.HasPrefix(before, "-") {
+		number = "-" + number
+		before = strings.TrimSpace(strings.TrimPrefix(before, "-"))
+	}
+	if commodity == "" {
+		commodity = strings.TrimSpace(before + " " + after)
+	}
+	if commodity == "" {
+		return LedgerAmount{}, errors.New("amount without commodity: " + s)
+	}
+	return LedgerAmount{number, commodity}, nil
+}
+
+func (la LedgerAmount) DecimalPlaces() int {
+	if i := strings.Index(la.Number, "."); i >= 0 {
+		return len(la.Number) - i - 1
+	}
+	return 0
+}
+
+func (lj *LedgerJournal) see(la LedgerAmount) {
+	if la.Number == "" {
+		return
+	}
+	if places := la.DecimalPlaces(); places > lj.Precision[la.Commodity] {
+		lj.Precision[la.Commodity] = places
+	} else if _, ok := lj.Precision[la.Commodity]; !ok {
+		lj.Precision[la.Commodity] = places
+	}
+}
+
+func (lj *LedgerJournal) see_account(name string) {
+	for _, known := range lj.Accounts {
+		if known == name {
+			return
+		}
+	}
+	lj.Accounts = append(lj.Accounts, name)
+}
+
+// Splits "text ; comment" and pulls tags and posting dates out of the comment
+func ledger_comment(s string) (string, string, map[string]bool, time.Time, error) {
+	text, comment := s, ""
+	if i := strings.Index(s, ";"); i >= 0 {
+		text, comment = s[:i], strings.TrimSpace(s[i+1:])
+	}
+	tags := make(map[string]bool)
+	for _, m := range ledger_tags_re.FindAllStringSubmatch(comment, -1) {
+		for _, tag := range strings.Split(strings.Trim(m[1], ":"), ":") {
+			tags[tag] = true
+		}
+	}
+	comment = strings.TrimSpace(ledger_tags_re.ReplaceAllString(comment, ""))
+	date := time.Time{}
+	var err error
+	if m := ledger_date_re.FindStringSubmatch(comment); m != nil {
+		date, err = parse_ledger_date(m[1] + m[2])
+		comment = strings.TrimSpace(strings.Replace(comment, m[0], "", 1))
+	}
+	return strings.TrimSpace(text), comment, tags, date, err
+}
+
+func parse_ledger(data string) (*LedgerJournal, error) {
+	lj := &LedgerJournal{Precision: make(map[string]int), Notes: make(map[string]string)}
+	// What indented lines belong to: "entry", "account <name>", "commodity <name>" or "" (ignored)
+	block := ""
+	var entry *LedgerEntry
+	fail := func(n int, err error) (*LedgerJournal, error) {
+		return nil, fmt.Errorf("line %d: %s", n, err.Error())
+	}
+	for i, raw := range strings.Split(strings.Replace(data, "\r", "", -1), "\n") {
+		n := i + 1
+		text := strings.TrimSpace(raw)
+		if text == "" {
+			block = ""
+			continue
+		}
+		indented := raw[0] == ' ' || raw[0] == '\t'
+
+		if indented {
+			switch {
+			case block == "entry":
+				err := entry.add_line(lj, text)
+				if err != nil {
+					return fail(n, err)
+				}
+			case strings.HasPrefix(block, "commodity "):
+				fields := strings.Fields(text)
+				if len(fields) > 1 && fields[0] == "format" {
+					la, err := parse_ledger_amount(strings.TrimPrefix(text, "format"))
+					if err != nil {
+						return fail(n, err)
+					}
+					lj.see(la)
+				}
+				if len(fields) > 1 && fields[0] == "note" {
+					lj.Notes[block] = strings.TrimSpace(strings.TrimPrefix(text, "note"))
+				}
+			case strings.HasPrefix(block, "account "):
+				if strings.HasPrefix(text, "note ") {
+					lj.Notes[block] = strings.TrimSpace(strings.TrimPrefix(text, "note"))
+				}
+			}
+			continue
+		}
+
+		block = ""
+		fields := strings.Fields(text)
+		switch {
+		case strings.ContainsAny(text[:1], ";#%|*"):
+			// Comment
+		case fields[0] == "commodity" && len(fields) > 1:
+			la, err := parse_ledger_amount(strings.TrimPrefix(text, "commodity"))
+			if err != nil || la.Number == "" {
+				// Just the symbol, e.g. "commodity BRL"
+				la = LedgerAmount{Commodity: strings.Trim(fields[1], "\"")}
+				if _, ok := lj.Precision[la.Commodity]; !ok {
+					lj.Precision[la.Commodity] = 0
+				}
+			}
+			lj.see(la)
+			block = "commodity " + la.Commodity
+		case fields[0] == "account" && len(fields) > 1:
+			name, _, _, _, _ := ledger_comment(strings.TrimSpace(strings.TrimPrefix(text, "account")))
+			lj.see_account(name)
+			block = "account " + name
+		case fields[0] == "P" && len(fields) >= 4:
+			date, err := parse_ledger_date(fields[1])
+			if err != nil {
+				return fail(n, err)
+			}
+			rest := fields[2:]
+			// Optional time
+			if strings.Contains(rest[0], ":") && len(rest) >= 3 {
+				rest = rest[1:]
+			}
+			la, err := parse_ledger_amount(strings.Join(rest[1:], " "))
+			if err != nil {
+				return fail(n, err)
+			}
+			lj.Prices = append(lj.Prices, LedgerPrice{date, strings.Trim(rest[0], "\""), la})
+		case unicode.IsDigit(rune(text[0])):
+			e, err := parse_ledger_header(text)
+			if err != nil {
+				return fail(n, err)
+			}
+			e.Line = n
+			lj.Entries = append(lj.Entries, e)
+			entry = &lj.Entries[len(lj.Entries)-1]
+			block = "entry"
+		default:
+			// Directives we do not need (include, alias, periodic transactions, ...)
+		}
+	}
+	// Prices and costs are often more precise than the commodity itself so they only count for commodities seen nowhere else
+	for _, e := range lj.Entries {
+		for _, lp := range e.Postings {
+			if _, ok := lj.Precision[lp.Cost.Commodity]; !ok && lp.Cost.Number != "" {
+				lj.see(lp.Cost)
+			}
+		}
+	}
+	for _, lp := range lj.Prices {
+		if _, ok := lj.Precision[lp.Amount.Commodity]; !ok {
+			lj.see(lp.Amount)
+		}
+		if _, ok := lj.Precision[lp.Commodity]; !ok {
+			lj.Precision[lp.Commodity] = 0
+		}
+	}
+	return lj, nil
+}
+
+// Reads "DATE[=DATE2] [*|!] [(CODE)] DESCRIPTION [; comment]"
+func parse_ledger_header(text string) (LedgerEntry, error) {
+	e := LedgerEntry{Tags: make(map[string]bool)}
+	text, comment, tags, _, err := ledger_comment(text)
+	if err != nil {
+		return e, err
+	}
+	e.Tags = tags
+	if comment != "" {
+		e.Comments = append(e.Comments, comment)
+	}
+	fields := strings.SplitN(text, " ", 2)
+	date := strings.SplitN(fields[0], "=", 2)[0]
+	e.Date, err = parse_ledger_date(date)
+	if err != nil {
+		return e, err
+	}
+	rest := ""
+	if len(fields) > 1 {
+		rest = strings.TrimSpace(fields[1])
+	}
+	if strings.HasPrefix(rest, "*") || strings.HasPrefix(rest, "!") {
+		e.Mark = rest[:1]
+		rest = strings.TrimSpace(rest[1:])
+	}
+	if strings.HasPrefix(rest, "(") {
+		if i := strings.Index(rest, ")"); i >= 0 {
+			rest = strings.TrimSpace(rest[i+1:])
+		}
+	}
+	e.Desc = rest
+	return e, nil
+}
+
+// Handles an indented line of an entry: either a comment or a posting
+func (e *LedgerEntry) add_line(lj *LedgerJournal, text string) error {
+	if strings.HasPrefix(text, ";") {
+		_, comment, tags, date, err := ledger_comment(text)
+		if err != nil {
+			return err
+		}
+		if len(e.Postings) == 0 {
+			if comment != "" {
+				e.Comments = append(e.Comments, comment)
+			}
+			for tag := range tags {
+				e.Tags[tag] = true
+			}
+			return nil
+		}
+		last := &e.Postings[len(e.Postings)-1]
+		last.Memo = strings.TrimSpace(last.Memo + " " + comment)
+		for tag := range tags {
+			last.Tags[tag] = true
+		}
+		if !date.IsZero() {
+			last.Date = date
+		}
+		return nil
+	}
+
+	text, comment, tags, date, err := ledger_comment(text)
+	if err != nil {
+		return err
+	}
+	lp := LedgerPosting{Memo: comment, Tags: tags, Date: date}
+	if strings.HasPrefix(text, "*") || strings.HasPrefix(text, "!") {
+		lp.Mark = text[:1]
+		text = strings.TrimSpace(text[1:])
+	}
+	// The account name ends at two spaces or a tab
+	account, amount := text, ""
+	if i := strings.Index(strings.Replace(text, "\t", "  ", -1), "  "); i >= 0 {
+		account, amount = text[:i], text[i:]
+	}
+	// Virtual postings are taken as regular ones
+	lp.Account = strings.Trim(account, "()[]")
+	lp.Amount, lp.Cost, err = parse_ledger_posting_amount(amount)
+	if err != nil {
+		return err
+	}
+	lj.see(lp.Amount)
+	lj.see_account(lp.Account)
+	if lp.Cost.Number != "" {
+		lj.see_account(LEDGER_CONVERSION_ACCOUNT)
+	}
+	e.Postings = append(e.Postings, lp)
+	return nil
+}
+
+// Picks wedge ids for journal account names: the last component when it is free, otherwise the whole name.
+// Returns the id of every name and the accounts that must be created.
+func ledger_map_accounts(names []string, notes map[string]string) (map[string]string, []Account) {
+	existing := make(map[string]string) // id -> parent
+	for _, acc := range load_accounts() {
+		existing[acc.Id] = acc.ParentId
+	}
+	ids := make(map[string]string)
+	created := make([]Account, 0)
+	var resolve func(name string) string
+	resolve = func(name string) string {
+		if id, ok := ids[name]; ok {
+			return id
+		}
+		parent := ""
+		short := name
+		if i := strings.LastIndex(name, ":"); i >= 0 {
+			parent = resolve(name[:i])
+			short = name[i+1:]
+		}
+		id := short
+		if cur_parent, ok := existing[id]; ok && cur_parent != parent {
+			id = strings.Replace(name, ":", "_", -1)
+		}
+		ids[name] = id
+		if _, ok := existing[id]; !ok {
+			existing[id] = parent
+			acc := NewAccount()
+			acc.Id = id
+			acc.ParentId = parent
+			acc.Name = short
+			if note, ok := notes["account "+name]; ok && note != "" {
+				acc.Name = note
+			}
+			created = append(created, *acc)
+		}
+		return id
+	}
+	for _, name := range names {
+		resolve(name)
+	}
+	return ids, created
+}
+
+// Usage: import ledger <file> [dry-run]
+func import_ledger_journal(line []string) {
+	usage := "Usage: import ledger <file> [dry-run]"
+	if len(line) < 1 || len(line) > 2 || (len(line) == 2 && line[1] != "dry-run") {
+		print_err(Red(usage))
+		return
+	}
+	dry_run := len(line) == 2
+	dat, err := ioutil.ReadFile(line[0])
+	if err != nil {
+		print_err(err.Error())
+		return
+	}
+	lj, err := parse_ledger(string(dat))
+	if err != nil {
+		print_err(Red(err.Error()))
+		return
+	}
+
+	// Commodities become asset kinds (existing ones keep their precision)
+	kinds := load_asset_kinds()
+	new_kinds := make([]AssetKind, 0)
+	for _, commodity := range sorted_keys(lj.Precision) {
+		if _, ok := kinds[commodity]; ok {
+			continue
+		}
+		ak := NewAssetKind()
+		ak.Id = commodity
+		ak.Name = commodity
+		if note, ok := lj.Notes["commodity "+commodity]; ok && note != "" {
+			ak.Name = note
+		}
+		ak.DecimalPlaces = lj.Precision[commodity]
+		kinds[commodity] = *ak
+		new_kinds = append(new_kinds, *ak)
+	}
+	raw := func(la LedgerAmount) int {
+		return parse_decimal(la.Number, kinds[la.Commodity].DecimalPlaces)
+	}
+	acc_ids, new_accs := ledger_map_accounts(lj.Accounts, lj.Notes)
+
+	prices := make([]AssetValue, 0)
+	for _, lp := range lj.Prices {
+		av := NewAssetValue()
+		av.AssetId = lp.Commodity
+		av.RefId = lp.Amount.Commodity
+		av.Value = raw(lp.Amount)
+		av.Date = lp.Date
+		prices = append(prices, *av)
+	}
+
+	trs := make([]Transaction, 0)
+	for _, e := range lj.Entries {
+		tr := NewTransaction()
+		tr.Name = e.Desc
+		tr.Desc = strings.Join(e.Comments, " ")
+		tr.Tags = e.Tags
+		tr.RefTimeSpan = TimePeriod{e.Date, EndOfDay(e.Date)}
+		elided := -1
+		// What the elided posting must balance, postings with a cost count in the commodity of their cost
+		sums := make(Balance)
+		for i, lp := range e.Postings {
+			if lp.Amount.Number == "" {
+				if elided >= 0 {
+					print_err(Red(fmt.Sprintf("line %d: more than one posting without amount", e.Line)))
+					return
+				}
+				elided = i
+				continue
+			}
+			tr.Parts = append(tr.Parts, ledger_part(tr.Id, e, lp, acc_ids[lp.Account], lp.Amount.Commodity, raw(lp.Amount)))
+			if lp.Cost.Number != "" {
+				sums[lp.Cost.Commodity] += raw(lp.Cost)
+				// As hledger does, the conversion account takes both sides so that every asset sums to zero
+				conv_id := acc_ids[LEDGER_CONVERSION_ACCOUNT]
+				tr.Parts = append(tr.Parts, ledger_part(tr.Id, e, lp, conv_id, lp.Amount.Commodity, -raw(lp.Amount)))
+				tr.Parts = append(tr.Parts, ledger_part(tr.Id, e, lp, conv_id, lp.Cost.Commodity, raw(lp.Cost)))
+			} else {
+				sums[lp.Amount.Commodity] += raw(lp.Amount)
+			}
+		}
+		// The posting without amount takes whatever balances the entry
+		if elided >= 0 {
+			lp := e.Postings[elided]
+			for _, asset_id := range sums.AssetIds() {
+				if sums[asset_id] != 0 {
+					tr.Parts = append(tr.Parts, ledger_part(tr.Id, e, lp, acc_ids[lp.Account], asset_id, -sums[asset_id]))
+				}
+			}
+		}
+		trs = append(trs, *tr)
+	}
+
+	// Preview
+	for _, ak := range new_kinds {
+		fmt.Printf("%s %s (%d decimal places)\n", Green("new asset kind"), Bold(ak.Id), ak.DecimalPlaces)
+	}
+	for _, acc := range new_accs {
+		fmt.Printf("%s %s %s\n", Green("new account"), Bold(acc.Id), Gray("parent: "+acc.ParentId))
+	}
+	fmt.Printf("%s %d asset kinds, %d accounts, %d prices and %d transactions\n", Bold("Preview:"), len(new_kinds), len(new_accs), len(prices), len(trs))
+	if dry_run {
+		return
+	}
+	flag := ToBool(ask_user(
+		LocalLine,
+		Sprintf(Bold("Import journal? [y/n] ")),
+		"",
+		nil,
+		IsBool))
+	if !flag {
+		fmt.Println(Bold("Import avoided"))
+		return
+	}
+	err = WithTx(func(q Querier) error {
+		for _, ak := range new_kinds {
+			err := ak.SaveWith(q)
+			if err != nil {
+				return err
+			}
+		}
+		for _, acc := range new_accs {
+			err := acc.SaveWith(q)
+			if err != nil {
+				return err
+			}
+		}
+		for _, av := range prices {
+			err := av.SaveWith(q)
+			if err != nil {
+				return err
+			}
+		}
+		for _, tr := range trs {
+			err := tr.SaveWith(q)
+			if err != nil {
+				return fmt.Errorf("%s: %s", tr.Name, err.Error())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		print_err(Red(err.Error()))
+		return
+	}
+	fmt.Println(Bold("Import done"))
+}
+
+func ledger_part(tr_id string, e LedgerEntry, lp LedgerPosting, acc_id, asset_id string, val int) TransactionPart {
+	tp := NewTransactionPart()
+	tp.TransactionId = tr_id
+	tp.AccountId = acc_id
+	tp.AssetKindId = asset_id
+	tp.Value = val
+	tp.Memo = lp.Memo
+	tp.Tags = lp.Tags
+	date := e.Date
+	if !lp.Date.IsZero() {
+		date = lp.Date
+	}
+	mark := e.Mark
+	if lp.Mark != "" {
+		mark = lp.Mark
+	}
+	tp.ScheduledFor = date
+	tp.ActualDate = date
+	tp.Status = ledger_status(mark, date)
+	return *tp
+}
+
+func sorted_keys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestParseLedgerPostingAmount(t *testing.T) {
+	tests := []struct {
+		input  string
+		amount LedgerAmount
+		cost   LedgerAmount
+		err    bool
+	}{
+		{"", LedgerAmount{}, LedgerAmount{}, false},
+		{"10 USD", LedgerAmount{"10", "USD"}, LedgerAmount{}, false},
+		{"$-10.50", LedgerAmount{"-10.50", "$"}, LedgerAmount{}, false},
+		{"-$1,000", LedgerAmount{"-1000", "$"}, LedgerAmount{}, false},
+		{"\"BTC-USD\" 1.5", LedgerAmount{"1.5", "BTC-USD"}, LedgerAmount{}, false},
+		{"10 AAPL = 20 AAPL", LedgerAmount{"10", "AAPL"}, LedgerAmount{}, false},
+		{"10 AAPL @ 150 USD", LedgerAmount{"10", "AAPL"}, LedgerAmount{"1500", "USD"}, false},
+		{"-10 AAPL @ 150 USD", LedgerAmount{"-10", "AAPL"}, LedgerAmount{"-1500", "USD"}, false},
+		{"2.5 AAPL @ 1.10 USD", LedgerAmount{"2.5", "AAPL"}, LedgerAmount{"2.750", "USD"}, false},
+		{"10 AAPL @@ 1500 USD", LedgerAmount{"10", "AAPL"}, LedgerAmount{"1500", "USD"}, false},
+		{"-10 AAPL @@ 1500 USD", LedgerAmount{"-10", "AAPL"}, LedgerAmount{"-1500", "USD"}, false},
+		{"-10 AAPL @@ -1500 USD", LedgerAmount{"-10", "AAPL"}, LedgerAmount{"-1500", "USD"}, false},
+		{"0 AAPL @@ 10.00 USD", LedgerAmount{"0", "AAPL"}, LedgerAmount{"0.00", "USD"}, false},
+		{"0 AAPL @ 150 USD", LedgerAmount{"0", "AAPL"}, LedgerAmount{"0", "USD"}, false},
+		{"@ 150 USD", LedgerAmount{}, LedgerAmount{"150", "USD"}, true},
+		{"10 AAPL @ USD", LedgerAmount{"10", "AAPL"}, LedgerAmount{}, true},
+	}
+	for _, test := range tests {
+		amount, cost, err := parse_ledger_posting_amount(test.input)
+		if (err != nil) != test.err {
+			t.Errorf("%q: unexpected error %v", test.input, err)
+			continue
+		}
+		if test.err {
+			continue
+		}
+		if amount != test.amount || cost != test.cost {
+			t.Errorf("%q: got %+v @ %+v, want %+v @ %+v", test.input, amount, cost, test.amount, test.cost)
+		}
+	}
+}
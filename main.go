@@ -4,12 +4,14 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/user"
 	"path/filepath"
+	"strings"
 
 	"github.com/chzyer/readline"
 	_ "github.com/mattn/go-sqlite3"
@@ -19,6 +21,7 @@ import (
 const UNSET_STR = "\tUNSET\n"
 
 var DB *sql.DB
+var DBFilename string
 var GlobalLine *readline.Instance
 var LocalLine *readline.Instance
 var NotImplementedErr = errors.New("Not Implemented")
@@ -44,7 +47,7 @@ func jsonToFile(filename string, v interface{}) error {
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(filename, dat, os.FileMode(int(0555)))
+	return ioutil.WriteFile(filename, dat, os.FileMode(int(0644)))
 }
 
 func set_str(source string, destination *string) {
@@ -54,6 +57,55 @@ func set_str(source string, destination *string) {
 }
 
 func main() {
+	var err error
+	db_flag := flag.String("db", "", "database file (default \"wedge.db\")")
+	cmd_flag := flag.String("c", "", "commands to run, separated by ';' or new lines")
+	flag.Parse()
+	args := flag.Args()
+
+	// Without -db, a single argument that looks like a file name is the database (e.g. 'wedge my.db')
+	DBFilename = "wedge.db"
+	if *db_flag != "" {
+		DBFilename = *db_flag
+	} else if len(args) == 1 && strings.Contains(args[0], ".") {
+		DBFilename = args[0]
+		args = args[1:]
+	}
+	Interactive = *cmd_flag == "" && len(args) == 0 && stdin_is_terminal()
+
+	// Open database
+	if Interactive {
+		fmt.Println("Opening database...")
+		fmt.Println("  Filename: " + DBFilename)
+	}
+	DB, err = sql.Open("sqlite3", DBFilename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer DB.Close()
+	EnsureTables(DB)
+	StrictDoubleEntry = ToBool(get_setting("strict", "off"))
+
+	switch {
+	case *cmd_flag != "":
+		for _, raw_line := range split_commands(*cmd_flag) {
+			if !run_line(raw_line) {
+				break
+			}
+		}
+	case len(args) > 0:
+		run_scripted(args)
+	case !Interactive:
+		run_batch(os.Stdin)
+	default:
+		repl()
+	}
+	if BatchFailed {
+		os.Exit(1)
+	}
+}
+
+func repl() {
 	var err error
 	// Preapre readline
 	GlobalLine, err = readline.NewEx(&readline.Config{
@@ -77,20 +129,6 @@ func main() {
 		log.Fatal(err)
 	}
 	defer LocalLine.Close()
-
-	// Open database
-	filename := "wedge.db"
-	if len(os.Args) > 1 {
-		filename = os.Args[1]
-	}
-	fmt.Println("Opening database...")
-	fmt.Println("  Filename: " + filename)
-	DB, err = sql.Open("sqlite3", filename)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer DB.Close()
-	EnsureTables(DB)
 	fmt.Println("Database ready")
 
 	for {
@@ -102,64 +140,16 @@ func main() {
 		if err != nil {
 			err_str = err.Error()
 		}
-		// Interpret
 		switch {
 		case len(line) == 0 && err_str != "EOF":
 			continue
 		case len(line) == 0 && err_str == "EOF":
-			os.Exit(0)
-		case line[0] == "exit" || err_str == "EOF":
-			os.Exit(0)
-		case line[0] == "account" && line[1] == "show":
-			account_show(line[2:])
-		case line[0] == "account" && line[1] == "add":
-			account_add(line[2:])
-		case line[0] == "account" && line[1] == "edit":
-			account_edit(line[2:])
-		case line[0] == "account" && line[1] == "del":
-			account_del(line[2:])
-		case line[0] == "asset" && line[1] == "kind" && line[2] == "show":
-			asset_kind_show(line[3:])
-		case line[0] == "asset" && line[1] == "kind" && line[2] == "add":
-			asset_kind_add(line[3:])
-		case line[0] == "asset" && line[1] == "kind" && line[2] == "edit":
-			asset_kind_edit(line[3:])
-		case line[0] == "asset" && line[1] == "kind" && line[2] == "del":
-			asset_kind_del(line[3:])
-		case line[0] == "asset" && line[1] == "value" && line[2] == "show":
-			asset_value_show(line[3:])
-		case line[0] == "asset" && line[1] == "value" && line[2] == "add":
-			asset_value_add(line[3:])
-		case line[0] == "asset" && line[1] == "value" && line[2] == "edit":
-			asset_value_edit(line[3:])
-		case line[0] == "asset" && line[1] == "value" && line[2] == "del":
-			asset_value_del(line[3:])
-		case line[0] == "transaction" && line[1] == "show":
-			transaction_show(line[2:])
-		case line[0] == "transaction" && line[1] == "add":
-			transaction_add(line[2:])
-		case line[0] == "transaction" && line[1] == "edit":
-			transaction_edit(line[2:])
-		case line[0] == "transaction" && line[1] == "del":
-			transaction_del(line[2:])
-		case line[0] == "transaction" && line[1] == "part" && line[2] == "show":
-			transaction_part_show(line[3:])
-		case line[0] == "transaction" && line[1] == "part" && line[2] == "add":
-			transaction_part_add(line[3:])
-		case line[0] == "transaction" && line[1] == "part" && line[2] == "edit":
-			transaction_part_edit(line[3:])
-		case line[0] == "transaction" && line[1] == "part" && line[2] == "del":
-			transaction_part_del(line[3:])
-		case line[0] == "transaction" && line[1] == "item" && line[2] == "show":
-			transaction_item_show(line[3:])
-		case line[0] == "transaction" && line[1] == "item" && line[2] == "add":
-			transaction_item_add(line[3:])
-		case line[0] == "transaction" && line[1] == "item" && line[2] == "edit":
-			transaction_item_edit(line[3:])
-		case line[0] == "transaction" && line[1] == "item" && line[2] == "del":
-			asset_value_del(line[3:])
-		default:
-			fmt.Printf("Unknown command: %+v Additional error: %+v\n", line, err)
+			return
+		case err_str == "EOF":
+			return
+		}
+		if !run_scripted(line) {
+			return
 		}
 	}
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/logrusorgru/aurora"
+)
+
+// Usage: networth <asset> [date]
+func networth(line []string) {
+	if len(line) < 1 || !IsAssetKind(line[0]) {
+		print_err(Red("Usage: networth <asset> [date]"))
+		return
+	}
+	ref := AssetKind{}
+	err := ref.Load(line[0])
+	if err != nil {
+		print_err(err.Error())
+		return
+	}
+	date := EndOfDay(time.Now())
+	if len(line) > 1 {
+		if !IsDay(line[1]) {
+			print_err(Red("Invalid date: " + line[1]))
+			return
+		}
+		date, _ = time.Parse(DAY_FMT, line[1])
+		date = EndOfDay(date)
+	}
+
+	accs := load_accounts()
+	direct := load_direct_balances(ClearedFilter(date))
+	totals := rollup_balances(accs, direct)
+	cv := NewConverter(date)
+	all_missing := make(map[string]bool)
+	fmt_balance := func(acc_id string) string {
+		val, missing := cv.ConvertBalance(totals[acc_id], ref.Id)
+		num := fmt_decimal(val, ref.DecimalPlaces)
+		if val >= 0 {
+			num = Sprintf(Cyan(num))
+		} else {
+			num = Sprintf(Red(num))
+		}
+		s := fmt.Sprintf("%s %s", num, Bold(ref.Id))
+		if len(missing) > 0 {
+			s += " " + Sprintf(Yellow("(no rate for "+strings.Join(missing, ", ")+")"))
+			for _, asset_id := range missing {
+				all_missing[asset_id] = true
+			}
+		}
+		return s
+	}
+
+	fmt.Printf("%s %s %s\n", Bold("Net worth in"), Bold(ref.Id), Gray("on "+date.Format(DAY_FMT)))
+	printed := make(map[string]bool)
+	account_balance_print_children(-1, Account{}, printed, accs, fmt_balance)
+
+	// Grand total over every account, including orphans
+	grand := make(Balance)
+	for _, bal := range direct {
+		grand.Add(bal)
+	}
+	val, missing := cv.ConvertBalance(grand, ref.Id)
+	for _, asset_id := range missing {
+		all_missing[asset_id] = true
+	}
+	total := Bold(Cyan(fmt_decimal(val, ref.DecimalPlaces)))
+	if val < 0 {
+		total = Bold(Red(fmt_decimal(val, ref.DecimalPlaces)))
+	}
+	fmt.Printf("%s %s %s\n", Bold("Total:"), total, Bold(ref.Id))
+	if len(all_missing) > 0 {
+		missing := make([]string, 0)
+		for asset_id := range all_missing {
+			missing = append(missing, asset_id)
+		}
+		sort.Strings(missing)
+		fmt.Println(Yellow(fmt.Sprintf("Warning: no rate on or before %s for %s; those assets are not included in the totals", date.Format(DAY_FMT), strings.Join(missing, ", "))))
+	}
+}
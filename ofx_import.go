@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/logrusorgru/aurora"
+)
+
+// OFX amounts have no thousands separators, so a lone comma is a decimal one (e.g. "-1,234" is -1.234).
+// When both appear (e.g. "1.234,56"), the last one separates the decimals and the other is skipped.
+func ofx_decimal_sep(amount string) string {
+	if strings.LastIndex(amount, ",") > strings.LastIndex(amount, ".") {
+		return ","
+	}
+	return "."
+}
+
+// A STMTTRN entry of an OFX statement
+type OfxTransaction struct {
+	Type   string
+	Posted time.Time
+	Amount string
+	FitId  string
+	Name   string
+	Memo   string
+}
+
+func (ot *OfxTransaction) set(tag, val string) error {
+	var err error
+	switch tag {
+	case "TRNTYPE":
+		ot.Type = val
+	case "DTPOSTED":
+		ot.Posted, err = parse_ofx_date(val)
+	case "TRNAMT":
+		ot.Amount = val
+	case "FITID":
+		ot.FitId = val
+	case "NAME":
+		ot.Name = val
+	case "MEMO":
+		ot.Memo = val
+	}
+	return err
+}
+
+// Something to show for the entry, preferring the payee name
+func (ot OfxTransaction) Title() string {
+	switch {
+	case ot.Name != "":
+		return ot.Name
+	case ot.Memo != "":
+		return ot.Memo
+	}
+	return ot.Type
+}
+
+// OFX dates look like YYYYMMDD[HHMMSS[.XXX]][[gmt offset:tz name]], only the day matters to us
+func parse_ofx_date(val string) (time.Time, error) {
+	if len(val) < 8 {
+		return time.Time{}, errors.New("invalid OFX date: " + val)
+	}
+	return time.Parse("20060102", val[:8])
+}
+
+var ofx_entities = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&quot;", "\"", "&apos;", "'", "&nbsp;", " ", "&amp;", "&")
+
+// Extracts the STMTTRN entries of an OFX file.
+// Handles both OFX 1.x (SGML, where leaf elements are not closed) and 2.x (XML) since closing tags are simply ignored.
+func parse_ofx(data string) ([]OfxTransaction, error) {
+	start := strings.Index(strings.ToUpper(data), "<OFX>")
+	if start < 0 {
+		return nil, errors.New("not an OFX file")
+	}
+	body := data[start:]
+	ans := make([]OfxTransaction, 0)
+	var cur *OfxTransaction
+	for {
+		lt := strings.Index(body, "<")
+		if lt < 0 {
+			break
+		}
+		gt := strings.Index(body[lt:], ">")
+		if gt < 0 {
+			break
+		}
+		tag := strings.ToUpper(strings.TrimSpace(body[lt+1 : lt+gt]))
+		body = body[lt+gt+1:]
+		next := strings.Index(body, "<")
+		if next < 0 {
+			next = len(body)
+		}
+		val := strings.TrimSpace(ofx_entities.Replace(body[:next]))
+
+		switch {
+		case tag == "STMTTRN":
+			cur = &OfxTransaction{}
+		case tag == "/STMTTRN":
+			if cur != nil {
+				ans = append(ans, *cur)
+			}
+			cur = nil
+		case cur != nil && val != "" && !strings.HasPrefix(tag, "/"):
+			err := cur.set(tag, val)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return ans, nil
+}
+
+// Tells whether the account already has a part with the given FITID
+func has_fitid(acc_id, fitid string) bool {
+	n := 0
+	err := DB.QueryRow("SELECT COUNT() FROM `TransactionPart` WHERE `AccountId` = ? AND `FitId` = ?", acc_id, fitid).Scan(&n)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return n > 0
+}
+
+// Usage: import ofx <file> <account> <asset> [dry-run]
+func import_ofx(line []string) {
+	usage := "Usage: import ofx <file> <account> <asset> [dry-run]"
+	if len(line) < 3 || len(line) > 4 || (len(line) == 4 && line[3] != "dry-run") {
+		print_err(Red(usage))
+		return
+	}
+	dry_run := len(line) == 4
+	acc_id := line[1]
+	if !IsAccount(acc_id) {
+		print_err(Red("No such account: " + acc_id))
+		return
+	}
+	ak := AssetKind{}
+	err := ak.Load(line[2])
+	if err != nil {
+		print_err(Red("No such asset kind: " + line[2]))
+		return
+	}
+	dat, err := ioutil.ReadFile(line[0])
+	if err != nil {
+		print_err(err.Error())
+		return
+	}
+	entries, err := parse_ofx(string(dat))
+	if err != nil {
+		print_err(Red(err.Error()))
+		return
+	}
+
+	// Preview, leaving out what was already imported
+	trs := make([]Transaction, 0)
+	seen := make(map[string]bool)
+	dups := 0
+	for _, ot := range entries {
+		if ot.FitId != "" && (seen[ot.FitId] || has_fitid(acc_id, ot.FitId)) {
+			dups++
+			continue
+		}
+		seen[ot.FitId] = true
+		// Some banks use a decimal comma
+		val, err := parse_amount(ot.Amount, ofx_decimal_sep(ot.Amount), ak.DecimalPlaces)
+		if err != nil {
+			print_err(Red(fmt.Sprintf("%s: %s", ot.FitId, err.Error())))
+			continue
+		}
+		num := fmt_decimal_pad(val, ak.DecimalPlaces, 11)
+		if val >= 0 {
+			num = Sprintf(Cyan(num))
+		} else {
+			num = Sprintf(Red(num))
+		}
+		fmt.Printf("%s %s %s %s\n", ot.Posted.Format(DAY_FMT), num, Bold(ak.Id), ot.Title())
+
+		tr := NewTransaction()
+		tr.Name = ot.Title()
+		tr.Desc = ot.Memo
+		tr.RefTimeSpan = TimePeriod{ot.Posted, EndOfDay(ot.Posted)}
+		tp := NewTransactionPart()
+		tp.TransactionId = tr.Id
+		tp.AccountId = acc_id
+		tp.AssetKindId = ak.Id
+		tp.Value = val
+		tp.Status = TS_FINISHED
+		tp.ScheduledFor = ot.Posted
+		tp.ActualDate = ot.Posted
+		tp.Memo = ot.Memo
+		tp.FitId = ot.FitId
+		tr.Parts = append(tr.Parts, *tp)
+		trs = append(trs, *tr)
+	}
+	fmt.Printf("%s %d new transactions, %d already imported\n", Bold("Preview:"), len(trs), dups)
+	if dry_run || len(trs) == 0 {
+		return
+	}
+
+	flag := ToBool(ask_user(
+		LocalLine,
+		Sprintf(Bold("Save transactions? [y/n] ")),
+		"",
+		nil,
+		IsBool))
+	if !flag {
+		fmt.Println(Bold("Import avoided"))
+		return
+	}
+	counter_id := ask_counter_account()
+	err = WithTx(func(q Querier) error {
+		for _, tr := range trs {
+			add_counter_parts(&tr, counter_id)
+			err := tr.SaveWith(q)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		print_err(err.Error())
+		return
+	}
+	fmt.Printf("%s %d transactions from %s\n", Bold("Imported"), len(trs), filepath.Base(line[0]))
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chzyer/readline"
+	. "github.com/logrusorgru/aurora"
+	"github.com/satori/go.uuid"
+)
+
+// Confirmation that the finished parts of an account matched a bank statement closing balance on a given day
+type Reconciliation struct {
+	Id          string
+	AccountId   string
+	AssetKindId string
+	Date        time.Time
+	Balance     int
+}
+
+var PcItemReconciliation = readline.PcItemDynamic(CompleteReconciliationFunc)
+
+func NewReconciliation() *Reconciliation {
+	rc := Reconciliation{}
+	rc.Init()
+	return &rc
+}
+
+func (rc *Reconciliation) Init() {
+	if rc.Id == "" {
+		rc.Id = uuid.NewV4().String()
+	}
+}
+
+func (rc Reconciliation) TypeName() string {
+	return "Reconciliation"
+}
+
+func (rc Reconciliation) ANSIString() string {
+	bal, err := full_decimal_fmt(rc.Balance, rc.AssetKindId)
+	if err != nil {
+		log.Println(err)
+	}
+	return fmt.Sprintf("%s %s %-14.14s %s %s", Sprintf(Gray(rc.Id)), rc.Date.Format(DAY_FMT), rc.AccountId, Cyan(fmt.Sprintf("%11.11s", bal)), Bold(fmt.Sprintf("%3.3s", rc.AssetKindId)))
+}
+
+func (rc *Reconciliation) Load(id string) error {
+	var date int64
+	err := DB.QueryRow("SELECT `Id`, `AccountId`, `AssetKindId`, `Date`, `Balance` FROM `Reconciliation` WHERE `Id` = ?", id).
+		Scan(&rc.Id, &rc.AccountId, &rc.AssetKindId, &date, &rc.Balance)
+	rc.Date = time.Unix(date, 0)
+	return err
+}
+
+func (rc *Reconciliation) SaveWith(q Querier) error {
+	rc.Init()
+	_, err := q.Exec("INSERT INTO `Reconciliation` (`Id`, `AccountId`, `AssetKindId`, `Date`, `Balance`) VALUES (?, ?, ?, ?, ?)",
+		rc.Id, rc.AccountId, rc.AssetKindId, rc.Date.Unix(), rc.Balance)
+	return err
+}
+
+// Marks the parts as reconciled by rc
+func (rc *Reconciliation) SaveParts(q Querier, part_ids []string) error {
+	for _, id := range part_ids {
+		_, err := q.Exec("UPDATE `TransactionPart` SET `ReconciliationId` = ? WHERE `Id` = ? AND `ReconciliationId` = ''", rc.Id, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unlocks the parts before removing the reconciliation itself
+func (rc Reconciliation) DelWith(q Querier, id string) error {
+	_, err := q.Exec("UPDATE `TransactionPart` SET `ReconciliationId` = '' WHERE `ReconciliationId` = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec("DELETE FROM `Reconciliation` WHERE `Id` = ?", id)
+	return err
+}
+
+// Fails if any part matching the condition (e.g. "`TransactionId` = ?") is locked by a reconciliation
+func check_unreconciled(q Querier, cond string, args ...interface{}) error {
+	id, rc_id := "", ""
+	err := q.QueryRow("SELECT `Id`, `ReconciliationId` FROM `TransactionPart` WHERE `ReconciliationId` != '' AND "+cond+" LIMIT 1", args...).Scan(&id, &rc_id)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("Part %s was reconciled by %s, undo the reconciliation first", id, rc_id)
+}
+
+func load_reconciliations(acc_id string) []Reconciliation {
+	rows, err := DB.Query("SELECT `Id` FROM `Reconciliation` WHERE `AccountId` = ? OR ? = '' ORDER BY `Date`", acc_id, acc_id)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ids := make([]string, 0)
+	for rows.Next() {
+		id := ""
+		err := rows.Scan(&id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	ans := make([]Reconciliation, 0, len(ids))
+	for _, id := range ids {
+		rc := Reconciliation{}
+		err := rc.Load(id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ans = append(ans, rc)
+	}
+	return ans
+}
+
+// Sum of the parts of the account already confirmed by previous reconciliations
+func reconciled_balance(acc_id, asset_id string) int {
+	total := 0
+	err := DB.QueryRow("SELECT IFNULL(SUM(`Value`), 0) FROM `TransactionPart` WHERE `AccountId` = ? AND `AssetKindId` = ? AND `ReconciliationId` != ''", acc_id, asset_id).Scan(&total)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return total
+}
+
+// Finished parts of the account not reconciled yet up to the end of the statement day, oldest first
+func load_unreconciled_parts(acc_id, asset_id string, end time.Time) []TransactionPart {
+	rows, err := DB.Query("SELECT `Id` FROM `TransactionPart` WHERE `AccountId` = ? AND `AssetKindId` = ? AND `ReconciliationId` = '' AND `Status` = ? AND `ActualDate` <= ? ORDER BY `ActualDate`, `Id`",
+		acc_id, asset_id, TS_FINISHED, end.Unix())
+	if err != nil {
+		log.Fatal(err)
+	}
+	ids := make([]string, 0)
+	for rows.Next() {
+		id := ""
+		err := rows.Scan(&id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	parts := make([]TransactionPart, 0, len(ids))
+	for _, id := range ids {
+		tp := TransactionPart{}
+		err := tp.Load(id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		parts = append(parts, tp)
+	}
+	return parts
+}
+
+// Parses a selection like '1 3 5-7' into the (zero based) indexes of n parts
+func parse_ticks(input string, n int) ([]int, error) {
+	ans := make([]int, 0)
+	for _, field := range strings.Fields(strings.Replace(input, ",", " ", -1)) {
+		first, last := field, field
+		if i := strings.Index(field, "-"); i > 0 {
+			first, last = field[:i], field[i+1:]
+		}
+		a, err1 := strconv.Atoi(first)
+		b, err2 := strconv.Atoi(last)
+		if err1 != nil || err2 != nil || a < 1 || b > n || a > b {
+			return nil, errors.New("Invalid selection: " + field)
+		}
+		for i := a; i <= b; i++ {
+			ans = append(ans, i-1)
+		}
+	}
+	return ans, nil
+}
+
+// Usage: reconcile <account>
+// Only finished parts are listed, settle the ones that already cleared the bank first.
+// Ticked parts are locked: they cannot be edited, settled or deleted until the reconciliation is undone.
+func reconcile(line []string) {
+	if len(line) != 1 {
+		print_err(Red("Usage: reconcile <account>"))
+		return
+	}
+	acc_id := line[0]
+	if !IsAccount(acc_id) {
+		print_err(Red("No such account: " + acc_id))
+		return
+	}
+	asset_id := ask_user(
+		LocalLine,
+		Sprintf(Bold("          Asset: ")),
+		"",
+		CompleterAssetKind,
+		IsAssetKind)
+	ak := AssetKind{}
+	err := ak.Load(asset_id)
+	if err != nil {
+		print_err(err.Error())
+		return
+	}
+	date_str := ask_user(
+		LocalLine,
+		Sprintf(Bold(" Statement date: ")),
+		time.Now().Format(DAY_FMT),
+		nil,
+		IsDay)
+	date, _ := time.Parse(DAY_FMT, date_str)
+	bal_str := ask_user(
+		LocalLine,
+		Sprintf(Bold("Closing balance: ")),
+		"",
+		nil,
+		IsFloat)
+	closing, err := full_decimal_parse(bal_str, ak.Id)
+	if err != nil {
+		print_err(err.Error())
+		return
+	}
+
+	opening := reconciled_balance(acc_id, ak.Id)
+	parts := load_unreconciled_parts(acc_id, ak.Id, EndOfDay(date))
+	ticked := make([]bool, len(parts))
+	cleared := func() int {
+		ans := opening
+		for i, tp := range parts {
+			if ticked[i] {
+				ans += tp.Value
+			}
+		}
+		return ans
+	}
+	finish := func() {
+		rc := NewReconciliation()
+		rc.AccountId = acc_id
+		rc.AssetKindId = ak.Id
+		rc.Date = date
+		rc.Balance = closing
+		ids := make([]string, 0)
+		for i, tp := range parts {
+			if ticked[i] {
+				ids = append(ids, tp.Id)
+			}
+		}
+		err := WithTx(func(q Querier) error {
+			err := rc.SaveWith(q)
+			if err != nil {
+				return err
+			}
+			return rc.SaveParts(q, ids)
+		})
+		if err != nil {
+			print_err(err.Error())
+			return
+		}
+		fmt.Printf("%s %d parts as %s\n", Bold("Reconciled"), len(ids), rc.Id)
+	}
+
+	fmt.Printf("%s %s\n", Bold("Previously reconciled:"), fmt_decimal(opening, ak.DecimalPlaces))
+	for {
+		for i, tp := range parts {
+			mark := "[ ]"
+			if ticked[i] {
+				mark = Sprintf(Green("[x]"))
+			}
+			fmt.Printf("%3d %s %s\n", i+1, mark, tp.ANSIString())
+		}
+		diff := closing - cleared()
+		diff_str := fmt_decimal(diff, ak.DecimalPlaces)
+		if diff == 0 {
+			diff_str = Sprintf(Green(diff_str))
+		} else {
+			diff_str = Sprintf(Red(diff_str))
+		}
+		fmt.Printf("%s %s  %s %s  %s %s\n",
+			Bold("Statement:"), fmt_decimal(closing, ak.DecimalPlaces),
+			Bold("Cleared:"), fmt_decimal(cleared(), ak.DecimalPlaces),
+			Bold("Difference:"), diff_str)
+
+		choice := ask_user_key(
+			"tick",
+			LocalLine,
+			Sprintf(Bold("Toggle parts (e.g. 1 3 5-7), [a]ll, [n]one, [d]one or [q]uit: ")),
+			"",
+			nil,
+			func(s string) bool {
+				if s == "a" || s == "n" || s == "d" || s == "q" {
+					return true
+				}
+				_, err := parse_ticks(s, len(parts))
+				return s != "" && err == nil
+			})
+		switch choice {
+		case "a", "n":
+			for i := range ticked {
+				ticked[i] = choice == "a"
+			}
+		case "q":
+			fmt.Println(Bold("Reconciliation avoided"))
+			return
+		case "d":
+			if diff == 0 {
+				finish()
+				return
+			}
+			print_err(Red("The difference must be zero to finish"))
+		default:
+			idxs, _ := parse_ticks(choice, len(parts))
+			for _, i := range idxs {
+				ticked[i] = !ticked[i]
+			}
+		}
+		// Without a terminal the selection (--tick) is given only once and finishes the reconciliation if it leaves no difference
+		if !Interactive {
+			if closing != cleared() {
+				print_err(Red("Reconciliation avoided: the difference is not zero"))
+				return
+			}
+			finish()
+			return
+		}
+	}
+}
+
+// Usage: reconciliation show [account]
+func reconciliation_show(line []string) {
+	acc_id := ""
+	if len(line) > 0 {
+		acc_id = line[0]
+	}
+	for _, rc := range load_reconciliations(acc_id) {
+		fmt.Println(rc.ANSIString())
+	}
+}
+
+// Usage: reconciliation undo <id>
+// The parts are unlocked and may be reconciled again.
+func reconciliation_undo(line []string) {
+	if len(line) == 0 {
+		print_err(Red("No id specified"))
+		return
+	}
+	rc := NewReconciliation()
+	err := rc.Load(line[len(line)-1])
+	if err != nil {
+		print_err(err.Error())
+		return
+	}
+	fmt.Println(rc.ANSIString())
+	flag := ToBool(ask_user(
+		LocalLine,
+		Sprintf(Bold("Undo reconciliation? [y/n] ")),
+		"",
+		nil,
+		IsBool))
+	if !flag {
+		fmt.Println(Bold("Undo avoided"))
+		return
+	}
+	err = WithTx(func(q Querier) error { return rc.DelWith(q, rc.Id) })
+	if err != nil {
+		print_err(err.Error())
+	}
+}
+
+func CompleteReconciliationFunc(prefix string) []string {
+	tmp := strings.Split(prefix, " ")
+	spec := tmp[len(tmp)-1]
+	found := make([]string, 0)
+	for _, id := range load_ids("Reconciliation") {
+		if strings.HasPrefix(id, spec) {
+			found = append(found, id)
+		}
+	}
+	return found
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/chzyer/readline"
+	. "github.com/logrusorgru/aurora"
+	"github.com/mgutz/str"
+	"github.com/satori/go.uuid"
+)
+
+const (
+	RR_MONTHLY           = "monthly"           // Every Every months on day Day (or the last day of shorter months)
+	RR_WEEKLY            = "weekly"            // Every Every weeks on the weekday of Start
+	RR_YEARLY            = "yearly"            // Every Every years on the month and day of Start
+	RR_LAST_BUSINESS_DAY = "last-business-day" // Last Monday to Friday of every Every months
+)
+
+var RecurrenceRules = []string{RR_MONTHLY, RR_WEEKLY, RR_YEARLY, RR_LAST_BUSINESS_DAY}
+
+// A rule that creates copies of Template on every occurrence
+type Recurring struct {
+	Id       string
+	Name     string
+	Rule     string
+	Every    int
+	Day      int
+	Start    time.Time
+	End      time.Time // Zero means forever
+	Template Transaction
+}
+
+var PcItemRecurring = readline.PcItemDynamic(CompleteRecurringFunc)
+
+func NewRecurring() *Recurring {
+	rec := Recurring{Rule: RR_MONTHLY, Every: 1, Day: 1}
+	rec.Template.Init()
+	return &rec
+}
+
+func (rec Recurring) TypeName() string {
+	return "Recurring"
+}
+
+func (rec Recurring) RuleString() string {
+	every := ""
+	if rec.Every > 1 {
+		every = fmt.Sprintf(" every %d", rec.Every)
+	}
+	switch rec.Rule {
+	case RR_MONTHLY:
+		if rec.Every > 1 {
+			return fmt.Sprintf("on day %d%s months", rec.Day, every)
+		}
+		return fmt.Sprintf("monthly on day %d", rec.Day)
+	case RR_WEEKLY:
+		if rec.Every > 1 {
+			return fmt.Sprintf("on %ss%s weeks", rec.Start.Weekday(), every)
+		}
+		return fmt.Sprintf("weekly on %ss", rec.Start.Weekday())
+	case RR_YEARLY:
+		if rec.Every > 1 {
+			return fmt.Sprintf("on %s%s years", rec.Start.Format("01-02"), every)
+		}
+		return fmt.Sprintf("yearly on %s", rec.Start.Format("01-02"))
+	case RR_LAST_BUSINESS_DAY:
+		if rec.Every > 1 {
+			return fmt.Sprintf("last business day%s months", every)
+		}
+		return "last business day of the month"
+	}
+	return rec.Rule
+}
+
+func (rec Recurring) ANSIString() string {
+	until := ""
+	if !rec.End.IsZero() {
+		until = " until " + rec.End.Format(DAY_FMT)
+	}
+	return fmt.Sprintf("%s %s %s %s", Sprintf(Gray(rec.Id)), Sprintf(Bold(fmt.Sprintf("%-19.19s", rec.Name))), rec.RuleString(), Gray("from "+rec.Start.Format(DAY_FMT)+until))
+}
+
+func (rec Recurring) MultilineString() string {
+	end := "never"
+	if !rec.End.IsZero() {
+		end = rec.End.Format(DAY_FMT)
+	}
+	s := ""
+	s += fmt.Sprintf("%s %s\n", Bold("   Id:"), rec.Id)
+	s += fmt.Sprintf("%s %s\n", Bold(" Name:"), rec.Name)
+	s += fmt.Sprintf("%s %s\n", Bold(" Rule:"), rec.RuleString())
+	s += fmt.Sprintf("%s %s\n", Bold("Start:"), rec.Start.Format(DAY_FMT))
+	s += fmt.Sprintf("%s %s\n", Bold("  End:"), end)
+	s += fmt.Sprintf("------------------------------ %s -------------------------------\n", Bold("Template"))
+	s += rec.Template.MultilineString()
+	return s
+}
+
+func (rec *Recurring) Load(id string) error {
+	var start, end int64
+	template := ""
+	err := DB.QueryRow("SELECT `Id`, `Name`, `Rule`, `Every`, `Day`, `Start`, `End`, `Template` FROM `Recurring` WHERE `Id` = ?", id).
+		Scan(&rec.Id, &rec.Name, &rec.Rule, &rec.Every, &rec.Day, &start, &end, &template)
+	if err != nil {
+		return err
+	}
+	rec.Start = time.Unix(start, 0).UTC()
+	rec.End = time.Time{}
+	if end != 0 {
+		rec.End = time.Unix(end, 0).UTC()
+	}
+	rec.Template = Transaction{}
+	err = json.Unmarshal([]byte(template), &rec.Template)
+	rec.Template.Init()
+	return err
+}
+
+func (rec Recurring) Save() error {
+	return WithTx(rec.SaveWith)
+}
+
+func (rec Recurring) SaveWith(q Querier) error {
+	if len(rec.Id) <= 0 {
+		return errors.New("All recurring transactions must have a non empty id")
+	}
+	_, err := q.Exec("INSERT INTO `Recurring` (`Id`, `Name`, `Rule`, `Every`, `Day`, `Start`, `End`, `Template`) VALUES (?, ?, '', 1, 0, 0, 0, '')", rec.Id, rec.Name)
+	if err != nil {
+		return err
+	}
+	return rec.UpdateWith(q)
+}
+
+func (rec Recurring) Update() error {
+	return WithTx(rec.UpdateWith)
+}
+
+func (rec Recurring) UpdateWith(q Querier) error {
+	template, err := json.Marshal(rec.Template)
+	if err != nil {
+		return err
+	}
+	end := int64(0)
+	if !rec.End.IsZero() {
+		end = rec.End.Unix()
+	}
+	_, err = q.Exec("UPDATE `Recurring` SET `Name` = ?, `Rule` = ?, `Every` = ?, `Day` = ?, `Start` = ?, `End` = ?, `Template` = ? WHERE `Id` = ?",
+		rec.Name, rec.Rule, rec.Every, rec.Day, rec.Start.Unix(), end, string(template), rec.Id)
+	return err
+}
+
+func (rec Recurring) Del(id string) error {
+	return WithTx(func(q Querier) error {
+		return rec.DelWith(q, id)
+	})
+}
+
+// Transactions already created are kept
+func (rec Recurring) DelWith(q Querier, id string) error {
+	_, err := q.Exec("DELETE FROM `Recurring` WHERE `Id` = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec("DELETE FROM `RecurringOccurrence` WHERE `RecurringId` = ?", id)
+	return err
+}
+
+func days_in_month(y int, m time.Month) int {
+	return time.Date(y, m+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// Same date in the given month, moved back to the last day of shorter months
+func clamp_day(y int, m time.Month, d int) time.Time {
+	// Normalize months past December
+	first := time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+	if n := days_in_month(first.Year(), first.Month()); d > n {
+		d = n
+	}
+	return time.Date(first.Year(), first.Month(), d, 0, 0, 0, 0, time.UTC)
+}
+
+func last_business_day(y int, m time.Month) time.Time {
+	ans := clamp_day(y, m, 31)
+	for ans.Weekday() == time.Saturday || ans.Weekday() == time.Sunday {
+		ans = ans.AddDate(0, 0, -1)
+	}
+	return ans
+}
+
+// Every date (UTC midnight, like the ones typed by users) on which the rule fires inside the period
+func (rec Recurring) Occurrences(period TimePeriod) []time.Time {
+	ans := make([]time.Time, 0)
+	every := rec.Every
+	if every < 1 {
+		every = 1
+	}
+	y, m, d := rec.Start.Date()
+	for i := 0; ; i++ {
+		var date time.Time
+		switch rec.Rule {
+		case RR_MONTHLY:
+			date = clamp_day(y, m+time.Month(i*every), rec.Day)
+		case RR_WEEKLY:
+			date = time.Date(y, m, d+7*i*every, 0, 0, 0, 0, time.UTC)
+		case RR_YEARLY:
+			date = clamp_day(y+i*every, m, d)
+		case RR_LAST_BUSINESS_DAY:
+			date = last_business_day(y, m+time.Month(i*every))
+		default:
+			return ans
+		}
+		if date.After(period.End) || (!rec.End.IsZero() && date.After(rec.End)) {
+			break
+		}
+		if !date.Before(rec.Start) && period.Contains(date) {
+			ans = append(ans, date)
+		}
+	}
+	return ans
+}
+
+// Copies the template to the given date with fresh ids and scheduled parts
+func (rec Recurring) Materialize(date time.Time) Transaction {
+	tr := Transaction{}
+	tr.Init()
+	tr.Name = rec.Template.Name
+	tr.Desc = rec.Template.Desc
+	tr.RefTimeSpan = TimePeriod{date, EndOfDay(date)}
+	for tag, set := range rec.Template.Tags {
+		tr.Tags[tag] = set
+	}
+	for _, tp := range rec.Template.Parts {
+		tp.Id = uuid.NewV4().String()
+		tp.TransactionId = tr.Id
+		tp.Status = TS_SCHEDULED
+		tp.ScheduledFor = date
+		tp.ActualDate = date
+		tp.FitId = ""
+		tp.ReconciliationId = ""
+		tr.Parts = append(tr.Parts, tp)
+	}
+	for _, ti := range rec.Template.Items {
+		ti.Id = uuid.NewV4().String()
+		ti.TransactionId = tr.Id
+		tr.Items = append(tr.Items, ti)
+	}
+	return tr
+}
+
+// A date on which a recurring transaction already fired, so that it never fires twice in the same period
+type RecurringOccurrence struct {
+	RecurringId   string
+	Date          time.Time
+	TransactionId string
+}
+
+// Occurrences have no id of their own
+func (occ RecurringOccurrence) Key() string {
+	return occ.RecurringId + " " + occ.Date.Format(DAY_FMT)
+}
+
+func (occ *RecurringOccurrence) Load(rec_id string, date time.Time) error {
+	var unix int64
+	err := DB.QueryRow("SELECT `RecurringId`, `Date`, `TransactionId` FROM `RecurringOccurrence` WHERE `RecurringId` = ? AND `Date` = ?", rec_id, date.Unix()).
+		Scan(&occ.RecurringId, &unix, &occ.TransactionId)
+	occ.Date = time.Unix(unix, 0).UTC()
+	return err
+}
+
+func (occ RecurringOccurrence) SaveWith(q Querier) error {
+	_, err := q.Exec("INSERT INTO `RecurringOccurrence` (`RecurringId`, `Date`, `TransactionId`) VALUES (?, ?, ?)", occ.RecurringId, occ.Date.Unix(), occ.TransactionId)
+	return err
+}
+
+func (occ RecurringOccurrence) DelWith(q Querier) error {
+	_, err := q.Exec("DELETE FROM `RecurringOccurrence` WHERE `RecurringId` = ? AND `Date` = ?", occ.RecurringId, occ.Date.Unix())
+	return err
+}
+
+func load_occurrences() []RecurringOccurrence {
+	rows, err := DB.Query("SELECT `RecurringId`, `Date`, `TransactionId` FROM `RecurringOccurrence` ORDER BY `RecurringId`, `Date`")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+	ans := make([]RecurringOccurrence, 0)
+	for rows.Next() {
+		var unix int64
+		occ := RecurringOccurrence{}
+		err := rows.Scan(&occ.RecurringId, &unix, &occ.TransactionId)
+		if err != nil {
+			log.Fatal(err)
+		}
+		occ.Date = time.Unix(unix, 0).UTC()
+		ans = append(ans, occ)
+	}
+	return ans
+}
+
+// The month, week (starting on Monday) or year of the rule that contains date, as [start, next)
+func (rec Recurring) Bucket(date time.Time) (time.Time, time.Time) {
+	y, m, d := date.Date()
+	switch rec.Rule {
+	case RR_WEEKLY:
+		start := time.Date(y, m, d-(int(date.Weekday())+6)%7, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 0, 7)
+	case RR_YEARLY:
+		start := time.Date(y, 1, 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(1, 0, 0)
+	}
+	start := time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 1, 0)
+}
+
+// Whether the rule already fired in the bucket of date, so that editing its day or start does not fire it twice in the same month
+func has_occurrence(rec Recurring, date time.Time) bool {
+	start, next := rec.Bucket(date)
+	n := 0
+	err := DB.QueryRow("SELECT COUNT() FROM `RecurringOccurrence` WHERE `RecurringId` = ? AND `Date` >= ? AND `Date` < ?", rec.Id, start.Unix(), next.Unix()).Scan(&n)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return n > 0
+}
+
+func load_recurring() []Recurring {
+	ans := make([]Recurring, 0)
+	for _, id := range load_ids("Recurring") {
+		rec := NewRecurring()
+		err := rec.Load(id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ans = append(ans, *rec)
+	}
+	return ans
+}
+
+// Usage: recurring run <period> [dry-run]
+// Occurrences that were already created (even if their transaction was deleted afterwards) are skipped,
+// as are those whose month (week or year, depending on the rule) already has one.
+func recurring_run(line []string) {
+	usage := "Usage: recurring run <period> [dry-run]"
+	dry_run := len(line) > 0 && line[len(line)-1] == "dry-run"
+	if dry_run {
+		line = line[:len(line)-1]
+	}
+	period, err := ParseTimePeriod(strings.Join(line, " "))
+	if len(line) == 0 || err != nil {
+		print_err(Red(usage))
+		return
+	}
+
+	type occurrence struct {
+		RecId string
+		Date  time.Time
+		Tr    Transaction
+	}
+	todo := make([]occurrence, 0)
+	for _, rec := range load_recurring() {
+		for _, date := range rec.Occurrences(period) {
+			if has_occurrence(rec, date) {
+				continue
+			}
+			todo = append(todo, occurrence{rec.Id, date, rec.Materialize(date)})
+			fmt.Printf("%s %s %s\n", date.Format(DAY_FMT), Bold(rec.Id), rec.Template.Name)
+		}
+	}
+	fmt.Printf("%s %d new transactions\n", Bold("Due:"), len(todo))
+	if dry_run || len(todo) == 0 {
+		return
+	}
+
+	err = WithTx(func(q Querier) error {
+		for _, occ := range todo {
+			err := occ.Tr.SaveWith(q)
+			if err != nil {
+				return fmt.Errorf("%s %s: %s", occ.RecId, occ.Date.Format(DAY_FMT), err.Error())
+			}
+			err = RecurringOccurrence{occ.RecId, occ.Date, occ.Tr.Id}.SaveWith(q)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		print_err(Red(err.Error()))
+		return
+	}
+	fmt.Println(Bold("Done"))
+}
+
+func IsRecurrenceRule(s string) bool {
+	for _, rule := range RecurrenceRules {
+		if s == rule {
+			return true
+		}
+	}
+	return false
+}
+
+func recurring_ask(rec *Recurring, template_required bool) {
+	rec.Name = ask_user(
+		LocalLine,
+		Sprintf(Bold("    Name: ")),
+		rec.Name,
+		nil,
+		True)
+	rules := make([]readline.PrefixCompleterInterface, 0)
+	for _, rule := range RecurrenceRules {
+		rules = append(rules, readline.PcItem(rule))
+	}
+	rec.Rule = ask_user(
+		LocalLine,
+		Sprintf(Bold("    Rule: ")),
+		rec.Rule,
+		readline.NewPrefixCompleter(rules...),
+		IsRecurrenceRule)
+	if rec.Rule == RR_MONTHLY {
+		rec.Day = str.ToIntOr(ask_user(
+			LocalLine,
+			Sprintf(Bold("     Day: ")),
+			Sprintf(rec.Day),
+			nil,
+			func(s string) bool { return IsInt(s) && str.ToIntOr(s, 0) >= 1 && str.ToIntOr(s, 0) <= 31 }), 1)
+	}
+	rec.Every = str.ToIntOr(ask_user(
+		LocalLine,
+		Sprintf(Bold("   Every: ")),
+		Sprintf(rec.Every),
+		nil,
+		func(s string) bool { return IsInt(s) && str.ToIntOr(s, 0) >= 1 }), 1)
+	start := ask_user(
+		LocalLine,
+		Sprintf(Bold("   Start: ")),
+		rec.Start.Format(DAY_FMT),
+		nil,
+		IsDay)
+	rec.Start, _ = time.Parse(DAY_FMT, start)
+	end_default := ""
+	if !rec.End.IsZero() {
+		end_default = rec.End.Format(DAY_FMT)
+	}
+	end := ask_user(
+		LocalLine,
+		Sprintf(Bold("     End: ")),
+		end_default,
+		nil,
+		func(s string) bool { return s == "" || IsDay(s) })
+	rec.End, _ = time.Parse(DAY_FMT, end)
+	// Parts and items are copied from an existing transaction
+	template_id := ask_user(
+		LocalLine,
+		Sprintf(Bold("Template: ")),
+		"",
+		CompleterTransaction,
+		func(s string) bool { return (s == "" && !template_required) || IsTransaction(s) })
+	if template_id != "" {
+		rec.Template = Transaction{}
+		err := rec.Template.Load(template_id)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func recurring_show(line []string) {
+	rec := NewRecurring()
+	if len(line) > 0 {
+		err := rec.Load(line[0])
+		if err != nil {
+			print_err(err.Error())
+			return
+		}
+		fmt.Printf(rec.MultilineString())
+		return
+	}
+	for _, rec := range load_recurring() {
+		fmt.Println(rec.ANSIString())
+	}
+}
+
+func recurring_add(line []string) {
+	rec := NewRecurring()
+	rec.Start, _ = time.Parse(DAY_FMT, time.Now().Format(DAY_FMT))
+	rec.Id = ask_user(
+		LocalLine,
+		Sprintf(Bold("      Id: ")),
+		"",
+		nil,
+		True)
+	recurring_ask(rec, true)
+	err := rec.Save()
+	if err != nil {
+		print_err(err.Error())
+	}
+}
+
+func recurring_edit(line []string) {
+	if len(line) == 0 {
+		print_err(Red("No id specified"))
+		return
+	}
+	rec := NewRecurring()
+	err := rec.Load(line[len(line)-1])
+	if err != nil {
+		print_err(err.Error())
+		return
+	}
+	fmt.Println(Bold("      Id:"), rec.Id, Gray("(non editable)"))
+	fmt.Println(Gray("Leave the template empty to keep the current one"))
+	recurring_ask(rec, false)
+	err = rec.Update()
+	if err != nil {
+		print_err(err.Error())
+	}
+}
+
+func recurring_del(line []string) {
+	if len(line) == 0 {
+		print_err(Red("No id specified"))
+		return
+	}
+	id := line[len(line)-1]
+	deleter(id, NewRecurring())
+}
+
+func CompleteRecurringFunc(prefix string) []string {
+	tmp := strings.Split(prefix, " ")
+	spec := tmp[len(tmp)-1]
+	found := make([]string, 0)
+	for _, id := range load_ids("Recurring") {
+		if strings.HasPrefix(id, spec) {
+			found = append(found, id)
+		}
+	}
+	return found
+}
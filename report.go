@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/logrusorgru/aurora"
+)
+
+// Totals of a tag (or tag expression) in a single asset
+type TagTotal struct {
+	Tag         string
+	AssetKindId string
+	Items       int // Sum of TransactionItem.TotalCost
+	In          int // Sum of the positive TransactionPart.Value
+	Out         int // Sum of the negative TransactionPart.Value
+}
+
+func (tt TagTotal) ANSIString(kinds map[string]AssetKind) string {
+	places := kinds[tt.AssetKindId].DecimalPlaces
+	items := Sprintf(Cyan(fmt_decimal_pad(tt.Items, places, 8)))
+	in := Sprintf(Cyan(fmt_decimal_pad(tt.In, places, 8)))
+	out := Sprintf(Red(fmt_decimal_pad(tt.Out, places, 8)))
+	return fmt.Sprintf("%-24.24s %s %s %s %s", tt.Tag, Bold(fmt.Sprintf("%3.3s", tt.AssetKindId)), items, in, out)
+}
+
+// Every tag in the database indexed by object type and id
+func load_all_tags() map[string]map[string]bool {
+	rows, err := DB.Query("SELECT `ObjectType`, `ObjectId`, `Tag` FROM `Tags`")
+	if err != nil {
+		log.Fatal(err)
+	}
+	ans := make(map[string]map[string]bool)
+	defer rows.Close()
+	for rows.Next() {
+		var obj_type, id, tag string
+		err := rows.Scan(&obj_type, &id, &tag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		key := obj_type + "\x00" + id
+		if ans[key] == nil {
+			ans[key] = make(map[string]bool)
+		}
+		ans[key][tag] = true
+	}
+	return ans
+}
+
+// Usage: report tags <day|week|month|year> <period> [--tag <expr>]
+// Parts and items also count under the tags of their transaction.
+// Positive and negative parts are summed apart, otherwise both legs of a tagged transaction would cancel out.
+// Without an expression, totals are grouped by tag. Otherwise, a single total for the matching objects is shown.
+func report_tags(line []string) {
+	args, expr, err := parse_tag_filter(line)
+	if err != nil {
+		print_err(Red(err.Error()))
+		return
+	}
+	if len(args) < 2 || !IsPeriodUnit(args[0]) {
+		print_err(Red("Usage: report tags <day|week|month|year> <period> [--tag <expr>]"))
+		return
+	}
+	period, err := ParseTimePeriod(strings.Join(args[1:], " "))
+	if err != nil {
+		print_err(err.Error())
+		return
+	}
+	expr_str := strings.Join(line[len(args):], " ")
+	expr_str = strings.TrimSpace(strings.TrimPrefix(expr_str, "--tag"))
+
+	kinds := load_asset_kinds()
+	all_tags := load_all_tags()
+	parts := load_parts_in_period(period)
+	items, item_dates := load_items_in_period(period)
+	// Which groups an object falls in
+	groups := func(obj_type, id, transaction_id string) []string {
+		tags := make(map[string]bool)
+		for tag := range all_tags[obj_type+"\x00"+id] {
+			tags[tag] = true
+		}
+		for tag := range all_tags["Transaction\x00"+transaction_id] {
+			tags[tag] = true
+		}
+		if expr == nil {
+			return tags_list(tags)
+		}
+		if expr(tags) {
+			return []string{expr_str}
+		}
+		return []string{}
+	}
+
+	for _, bucket := range period.Split(args[0]) {
+		totals := make(map[string]*TagTotal)
+		get := func(tag, asset_id string) *TagTotal {
+			key := tag + "\x00" + asset_id
+			if totals[key] == nil {
+				totals[key] = &TagTotal{Tag: tag, AssetKindId: asset_id}
+			}
+			return totals[key]
+		}
+		for _, tp := range parts {
+			if !bucket.Contains(tp.EffectiveDate()) {
+				continue
+			}
+			for _, tag := range groups(tp.TypeName(), tp.Id, tp.TransactionId) {
+				if tp.Value >= 0 {
+					get(tag, tp.AssetKindId).In += tp.Value
+				} else {
+					get(tag, tp.AssetKindId).Out += tp.Value
+				}
+			}
+		}
+		for i, ti := range items {
+			if !bucket.Contains(item_dates[i]) {
+				continue
+			}
+			for _, tag := range groups(ti.TypeName(), ti.Id, ti.TransactionId) {
+				get(tag, ti.AssetKindId).Items += ti.TotalCost
+			}
+		}
+		if len(totals) == 0 {
+			continue
+		}
+
+		rows := make([]TagTotal, 0, len(totals))
+		for _, tt := range totals {
+			rows = append(rows, *tt)
+		}
+		sort.Slice(rows, func(i, j int) bool {
+			if rows[i].Tag != rows[j].Tag {
+				return rows[i].Tag < rows[j].Tag
+			}
+			return rows[i].AssetKindId < rows[j].AssetKindId
+		})
+		fmt.Printf("------------------------------ %s -------------------------------\n", Bold(bucket.StringDay()))
+		fmt.Printf("%-24.24s %3.3s %12s %12s %12s\n", "Tag", "", "Items", "In", "Out")
+		for _, tt := range rows {
+			fmt.Println(tt.ANSIString(kinds))
+		}
+	}
+}
+
+// Usage: overdue [date]
+// Lists the scheduled parts whose date is before the given day (today by default), oldest first.
+func overdue(line []string) {
+	day, _ := time.Parse(DAY_FMT, time.Now().Format(DAY_FMT))
+	if len(line) > 0 {
+		if !IsDay(line[0]) {
+			print_err(Red("Usage: overdue [date]"))
+			return
+		}
+		day, _ = time.Parse(DAY_FMT, line[0])
+	}
+	rows, err := DB.Query("SELECT `Id` FROM `TransactionPart` WHERE `Status` = ? AND `ScheduledFor` < ? ORDER BY `ScheduledFor`", TS_SCHEDULED, day.Unix())
+	if err != nil {
+		log.Fatal(err)
+	}
+	ids := make([]string, 0)
+	for rows.Next() {
+		id := ""
+		err := rows.Scan(&id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	kinds := load_asset_kinds()
+	total := make(Balance)
+	for _, id := range ids {
+		tp := NewTransactionPart()
+		err := tp.Load(id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		late := int(day.Sub(tp.ScheduledFor).Hours() / 24)
+		fmt.Printf("%s %s\n", tp.ANSIString(), Yellow(fmt.Sprintf("(%d days late)", late)))
+		total[tp.AssetKindId] += tp.Value
+	}
+	if len(ids) == 0 {
+		fmt.Println(Green("Nothing overdue"))
+		return
+	}
+	fmt.Printf("%s %d parts, %s\n", Bold("Overdue:"), len(ids), total.ANSIString(kinds))
+	fmt.Println(Gray("Use 'transaction part settle <id> [date] [actual value]' once they happen"))
+}
@@ -2,23 +2,222 @@ package main
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"time"
+
+	. "github.com/logrusorgru/aurora"
+	"github.com/mgutz/str"
 )
 
+type Migration struct {
+	Version int
+	Desc    string
+	Codes   []string
+}
+
+// Ordered list of schema changes. Never edit a migration that was already released, append a new one instead.
+var Migrations = []Migration{
+	{1, "Initial schema", []string{
+		"CREATE TABLE IF NOT EXISTS `Account` ( `Id` TEXT NOT NULL UNIQUE, `ParentId` TEXT NOT NULL, `Name` TEXT NOT NULL, `Desc` TEXT NOT NULL, PRIMARY KEY(`Id`));",
+		"CREATE TABLE IF NOT EXISTS `AssetKind` ( `Id` TEXT NOT NULL UNIQUE, `Name` TEXT NOT NULL, `Desc` TEXT NOT NULL, `DecimalPlaces` INTEGER NOT NULL DEFAULT 0, PRIMARY KEY(`Id`));",
+		"CREATE TABLE IF NOT EXISTS `AssetValue` ( `Id` TEXT NOT NULL UNIQUE, `AssetId` TEXT NOT NULL, `RefId` TEXT NOT NULL, `Value` INTEGER NOT NULL DEFAULT 0, `Date` INTEGER NOT NULL DEFAULT 0, `Notes` TEXT NOT NULL, PRIMARY KEY(`Id`));",
+		"CREATE TABLE IF NOT EXISTS `Tags` ( `ObjectId` TEXT NOT NULL, `Tag` TEXT NOT NULL );",
+		"CREATE UNIQUE INDEX IF NOT EXISTS `IndexUniTag` ON `Tags` (`ObjectId` ASC,`Tag` ASC);",
+		"CREATE TABLE IF NOT EXISTS `Transaction` ( `Id` TEXT NOT NULL UNIQUE, `Name` TEXT NOT NULL, `Desc` TEXT NOT NULL, `RefStart` INTEGER NOT NULL DEFAULT 0, `RefEnd` INTEGER NOT NULL DEFAULT 0, PRIMARY KEY(`Id`));",
+		"CREATE TABLE IF NOT EXISTS `TransactionPart` ( `Id` TEXT NOT NULL UNIQUE, `TransactionId` TEXT NOT NULL, `AccountId` TEXT NOT NULL, `Status` TEXT NOT NULL, `ScheduledFor` INTEGER NOT NULL DEFAULT 0, `ActualDate` INTEGER NOT NULL DEFAULT 0, `Value` INTEGER NOT NULL DEFAULT 0, `AssetKindId` TEXT NOT NULL, PRIMARY KEY(`Id`));",
+		"CREATE TABLE IF NOT EXISTS `TransactionItem` ( `Id` TEXT NOT NULL UNIQUE, `TransactionId` TEXT NOT NULL, `Name` TEXT NOT NULL, `UnitCost` INTEGER NOT NULL DEFAULT 0, `AssetKindId` TEXT NOT NULL, `Quantity` REAL NOT NULL,  `TotalCost` INTEGER NOT NULL, PRIMARY KEY(`Id`));",
+	}},
+	{2, "Indexes for the most common lookups", []string{
+		"CREATE INDEX IF NOT EXISTS `IndexPartTransaction` ON `TransactionPart` (`TransactionId`);",
+		"CREATE INDEX IF NOT EXISTS `IndexPartAccount` ON `TransactionPart` (`AccountId`, `AssetKindId`);",
+		"CREATE INDEX IF NOT EXISTS `IndexItemTransaction` ON `TransactionItem` (`TransactionId`);",
+		"CREATE INDEX IF NOT EXISTS `IndexAssetValuePair` ON `AssetValue` (`AssetId`, `RefId`, `Date`);",
+	}},
+	{3, "Tags know the type of the tagged object", []string{
+		"ALTER TABLE `Tags` ADD COLUMN `ObjectType` TEXT NOT NULL DEFAULT '';",
+		"DROP INDEX IF EXISTS `IndexUniTag`;",
+		"CREATE UNIQUE INDEX `IndexUniTag` ON `Tags` (`ObjectType` ASC, `ObjectId` ASC, `Tag` ASC);",
+		"CREATE INDEX `IndexTag` ON `Tags` (`Tag`);",
+	}},
+	{4, "Part memos and CSV import profiles", []string{
+		"ALTER TABLE `TransactionPart` ADD COLUMN `Memo` TEXT NOT NULL DEFAULT '';",
+		"CREATE TABLE `CsvProfile` ( `Id` TEXT NOT NULL UNIQUE, `Delimiter` TEXT NOT NULL, `HeaderRows` INTEGER NOT NULL DEFAULT 0, `DateColumn` TEXT NOT NULL, `DateFormat` TEXT NOT NULL, `AmountColumn` TEXT NOT NULL, `DecimalSep` TEXT NOT NULL, `DescColumn` TEXT NOT NULL, `AccountId` TEXT NOT NULL, `AssetKindId` TEXT NOT NULL, PRIMARY KEY(`Id`));",
+	}},
+	{5, "Bank ids of imported parts", []string{
+		"ALTER TABLE `TransactionPart` ADD COLUMN `FitId` TEXT NOT NULL DEFAULT '';",
+		"CREATE INDEX `IndexPartFitId` ON `TransactionPart` (`AccountId`, `FitId`);",
+	}},
+	{6, "Recurring transactions", []string{
+		"CREATE TABLE `Recurring` ( `Id` TEXT NOT NULL UNIQUE, `Name` TEXT NOT NULL, `Rule` TEXT NOT NULL, `Every` INTEGER NOT NULL DEFAULT 1, `Day` INTEGER NOT NULL DEFAULT 0, `Start` INTEGER NOT NULL DEFAULT 0, `End` INTEGER NOT NULL DEFAULT 0, `Template` TEXT NOT NULL, PRIMARY KEY(`Id`));",
+		"CREATE TABLE `RecurringOccurrence` ( `RecurringId` TEXT NOT NULL, `Date` INTEGER NOT NULL, `TransactionId` TEXT NOT NULL );",
+		"CREATE UNIQUE INDEX `IndexUniOccurrence` ON `RecurringOccurrence` (`RecurringId`, `Date`);",
+	}},
+	{7, "Budgets", []string{
+		"CREATE TABLE `Budget` ( `Id` TEXT NOT NULL UNIQUE, `AccountId` TEXT NOT NULL, `Tag` TEXT NOT NULL, `AssetKindId` TEXT NOT NULL, `Amount` INTEGER NOT NULL DEFAULT 0, `Start` INTEGER NOT NULL DEFAULT 0, `End` INTEGER NOT NULL DEFAULT 0, PRIMARY KEY(`Id`));",
+		"CREATE INDEX `IndexBudgetAccount` ON `Budget` (`AccountId`);",
+	}},
+	{8, "Bank reconciliations", []string{
+		"CREATE TABLE `Reconciliation` ( `Id` TEXT NOT NULL UNIQUE, `AccountId` TEXT NOT NULL, `AssetKindId` TEXT NOT NULL, `Date` INTEGER NOT NULL DEFAULT 0, `Balance` INTEGER NOT NULL DEFAULT 0, PRIMARY KEY(`Id`));",
+		"ALTER TABLE `TransactionPart` ADD COLUMN `ReconciliationId` TEXT NOT NULL DEFAULT '';",
+	}},
+	{9, "Persistent settings", []string{
+		"CREATE TABLE `Setting` ( `Key` TEXT NOT NULL UNIQUE, `Value` TEXT NOT NULL, PRIMARY KEY(`Key`));",
+	}},
+}
+
+func LatestSchemaVersion() int {
+	return Migrations[len(Migrations)-1].Version
+}
+
+func SchemaVersion(db *sql.DB) int {
+	version := 0
+	err := db.QueryRow("SELECT IFNULL(MAX(`Version`), 0) FROM `SchemaVersion`").Scan(&version)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return version
+}
+
+// Applies, in order, every migration after the current version up to target.
+// Each migration runs inside its own SQL transaction.
+func Migrate(db *sql.DB, target int) error {
+	current := SchemaVersion(db)
+	for _, mig := range Migrations {
+		if mig.Version <= current || mig.Version > target {
+			continue
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, code := range mig.Codes {
+			_, err = tx.Exec(code)
+			if err != nil {
+				tx.Rollback()
+				return fmt.Errorf("Migration %d failed: %s", mig.Version, err.Error())
+			}
+		}
+		_, err = tx.Exec("INSERT INTO `SchemaVersion` (`Version`, `Desc`, `AppliedAt`) VALUES (?, ?, ?)", mig.Version, mig.Desc, time.Now().Unix())
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("  Applied migration %d: %s\n", mig.Version, mig.Desc)
+	}
+	return nil
+}
+
+// Creates the version table and brings the database up to date.
+// Outdated databases are copied before being upgraded, since every query expects the latest schema.
 func EnsureTables(db *sql.DB) {
-	codes := make([]string, 0)
-	codes = append(codes, "CREATE TABLE IF NOT EXISTS `Account` ( `Id` TEXT NOT NULL UNIQUE, `ParentId` TEXT NOT NULL, `Name` TEXT NOT NULL, `Desc` TEXT NOT NULL, PRIMARY KEY(`Id`));")
-	codes = append(codes, "CREATE TABLE IF NOT EXISTS `AssetKind` ( `Id` TEXT NOT NULL UNIQUE, `Name` TEXT NOT NULL, `Desc` TEXT NOT NULL, `DecimalPlaces` INTEGER NOT NULL DEFAULT 0, PRIMARY KEY(`Id`));")
-	codes = append(codes, "CREATE TABLE IF NOT EXISTS `AssetValue` ( `Id` TEXT NOT NULL UNIQUE, `AssetId` TEXT NOT NULL, `RefId` TEXT NOT NULL, `Value` INTEGER NOT NULL DEFAULT 0, `Date` INTEGER NOT NULL DEFAULT 0, `Notes` TEXT NOT NULL, PRIMARY KEY(`Id`));")
-	codes = append(codes, "CREATE TABLE IF NOT EXISTS `Tags` ( `ObjectId` TEXT NOT NULL, `Tag` TEXT NOT NULL );")
-	codes = append(codes, "CREATE UNIQUE INDEX IF NOT EXISTS `IndexUniTag` ON `Tags` (`ObjectId` ASC,`Tag` ASC);")
-	codes = append(codes, "CREATE TABLE IF NOT EXISTS `Transaction` ( `Id` TEXT NOT NULL UNIQUE, `Name` TEXT NOT NULL, `Desc` TEXT NOT NULL, `RefStart` INTEGER NOT NULL DEFAULT 0, `RefEnd` INTEGER NOT NULL DEFAULT 0, PRIMARY KEY(`Id`));")
-	codes = append(codes, "CREATE TABLE IF NOT EXISTS `TransactionPart` ( `Id` TEXT NOT NULL UNIQUE, `TransactionId` TEXT NOT NULL, `AccountId` TEXT NOT NULL, `Status` TEXT NOT NULL, `ScheduledFor` INTEGER NOT NULL DEFAULT 0, `ActualDate` INTEGER NOT NULL DEFAULT 0, `Value` INTEGER NOT NULL DEFAULT 0, `AssetKindId` TEXT NOT NULL, PRIMARY KEY(`Id`));")
-	codes = append(codes, "CREATE TABLE IF NOT EXISTS `TransactionItem` ( `Id` TEXT NOT NULL UNIQUE, `TransactionId` TEXT NOT NULL, `Name` TEXT NOT NULL, `UnitCost` INTEGER NOT NULL DEFAULT 0, `AssetKindId` TEXT NOT NULL, `Quantity` REAL NOT NULL,  `TotalCost` INTEGER NOT NULL, PRIMARY KEY(`Id`));")
-	for _, code := range codes {
-		_, err := db.Exec(code)
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS `SchemaVersion` ( `Version` INTEGER NOT NULL UNIQUE, `Desc` TEXT NOT NULL, `AppliedAt` INTEGER NOT NULL DEFAULT 0, PRIMARY KEY(`Version`));")
+	if err != nil {
+		log.Fatal(err)
+	}
+	n := 0
+	err = db.QueryRow("SELECT COUNT() FROM `sqlite_master` WHERE `type` = 'table' AND `name` != 'SchemaVersion'").Scan(&n)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if n == 0 || SchemaVersion(db) == 0 {
+		// Brand new database or one created before versioning (the first migration is idempotent)
+		err = Migrate(db, 1)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if n == 0 {
+		err = Migrate(db, LatestSchemaVersion())
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
+	if SchemaVersion(db) < LatestSchemaVersion() {
+		fmt.Println(Yellow(fmt.Sprintf("  Schema version %d is outdated (latest is %d), upgrading", SchemaVersion(db), LatestSchemaVersion())))
+		err = backup_and_migrate(db, LatestSchemaVersion())
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// Copies the database file to '<file>.v<version>.bak' and only then migrates it
+func backup_and_migrate(db *sql.DB, target int) error {
+	backup := fmt.Sprintf("%s.v%d.bak", DBFilename, SchemaVersion(db))
+	err := copy_file(DBFilename, backup)
+	if err != nil {
+		return errors.New("Failed to back up database: " + err.Error())
+	}
+	fmt.Println(Bold("Backup saved to"), backup)
+	return Migrate(db, target)
+}
+
+func copy_file(src, dst string) error {
+	dat, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, dat, os.FileMode(int(0644)))
+}
+
+// Returns the stored value of a setting or def if it was never set
+func get_setting(key, def string) string {
+	val := ""
+	err := DB.QueryRow("SELECT `Value` FROM `Setting` WHERE `Key` = ?", key).Scan(&val)
+	if err == sql.ErrNoRows {
+		return def
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return val
+}
+
+func set_setting(key, val string) error {
+	_, err := DB.Exec("INSERT OR REPLACE INTO `Setting` (`Key`, `Value`) VALUES (?, ?)", key, val)
+	return err
+}
+
+// Usage: db version
+func db_version(line []string) {
+	current := SchemaVersion(DB)
+	fmt.Println(Bold("Current version:"), current)
+	fmt.Println(Bold(" Latest version:"), LatestSchemaVersion())
+	for _, mig := range Migrations {
+		if mig.Version > current {
+			fmt.Printf("  %s %d: %s\n", Yellow("pending"), mig.Version, mig.Desc)
+		}
+	}
+}
+
+// Usage: db migrate [version]
+// A copy of the database file is made before anything is changed.
+func db_migrate(line []string) {
+	target := LatestSchemaVersion()
+	if len(line) > 0 {
+		target = str.ToIntOr(line[0], -1)
+		if target < 0 || target > LatestSchemaVersion() {
+			print_err(Red("Invalid version: " + line[0]))
+			return
+		}
+	}
+	current := SchemaVersion(DB)
+	if current >= target {
+		fmt.Println(Bold("Nothing to do"))
+		return
+	}
+	err := backup_and_migrate(DB, target)
+	if err != nil {
+		print_err(Red(err.Error()))
+		return
+	}
+	fmt.Println(Bold(fmt.Sprintf("Database is now at version %d", SchemaVersion(DB))))
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+)
+
+// A boolean expression over tags, e.g. 'groceries AND NOT (work OR trip-2026)'
+// Adjacent terms are implicitly joined with AND.
+type TagExpr func(tags map[string]bool) bool
+
+type tag_expr_parser struct {
+	tokens []string
+	pos    int
+}
+
+func tokenize_tag_expr(input string) []string {
+	input = strings.Replace(input, "(", " ( ", -1)
+	input = strings.Replace(input, ")", " ) ", -1)
+	return strings.Fields(input)
+}
+
+func ParseTagExpr(input string) (TagExpr, error) {
+	p := tag_expr_parser{tokens: tokenize_tag_expr(input)}
+	if len(p.tokens) == 0 {
+		return nil, errors.New("Empty tag expression")
+	}
+	expr, err := p.parse_or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, errors.New("Unexpected token in tag expression: " + p.tokens[p.pos])
+	}
+	return expr, nil
+}
+
+func (p *tag_expr_parser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *tag_expr_parser) parse_or() (TagExpr, error) {
+	left, err := p.parse_and()
+	if err != nil {
+		return nil, err
+	}
+	for strings.ToUpper(p.peek()) == "OR" {
+		p.pos++
+		right, err := p.parse_and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(tags map[string]bool) bool { return l(tags) || right(tags) }
+	}
+	return left, nil
+}
+
+func (p *tag_expr_parser) parse_and() (TagExpr, error) {
+	left, err := p.parse_not()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		next := strings.ToUpper(p.peek())
+		if next == "" || next == "OR" || next == ")" {
+			return left, nil
+		}
+		if next == "AND" {
+			p.pos++
+		}
+		right, err := p.parse_not()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(tags map[string]bool) bool { return l(tags) && right(tags) }
+	}
+}
+
+func (p *tag_expr_parser) parse_not() (TagExpr, error) {
+	if strings.ToUpper(p.peek()) == "NOT" {
+		p.pos++
+		inner, err := p.parse_not()
+		if err != nil {
+			return nil, err
+		}
+		return func(tags map[string]bool) bool { return !inner(tags) }, nil
+	}
+	return p.parse_atom()
+}
+
+func (p *tag_expr_parser) parse_atom() (TagExpr, error) {
+	tok := p.peek()
+	switch strings.ToUpper(tok) {
+	case "":
+		return nil, errors.New("Unexpected end of tag expression")
+	case "AND", "OR", ")":
+		return nil, errors.New("Unexpected token in tag expression: " + tok)
+	case "(":
+		p.pos++
+		inner, err := p.parse_or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, errors.New("Missing ')' in tag expression")
+		}
+		p.pos++
+		return inner, nil
+	}
+	p.pos++
+	return func(tags map[string]bool) bool { return tags[tok] }, nil
+}
+
+// Extracts a trailing '--tag <expr>' from the command line.
+// Returns the remaining arguments and the expression (nil when there is none).
+func parse_tag_filter(line []string) ([]string, TagExpr, error) {
+	for i, arg := range line {
+		if arg == "--tag" {
+			expr, err := ParseTagExpr(strings.Join(line[i+1:], " "))
+			return line[:i], expr, err
+		}
+	}
+	return line, nil, nil
+}
+
+// Show commands list at most 64 objects, unless they are being filtered by tags
+func show_limit(expr TagExpr) string {
+	if expr != nil {
+		return ""
+	}
+	return " LIMIT 64"
+}
+
+// Tags of an object, merged with the ones of its transaction (if any)
+func effective_tags(obj_type, id, transaction_id string) map[string]bool {
+	tags, err := load_tags(DB, obj_type, id)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if transaction_id != "" {
+		tr_tags, err := load_tags(DB, "Transaction", transaction_id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for tag := range tr_tags {
+			tags[tag] = true
+		}
+	}
+	return tags
+}
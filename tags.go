@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	. "github.com/logrusorgru/aurora"
+)
+
+// Every type of object that can be tagged. The names match both TypeName() and the table names.
+var TaggableTypes = []string{"Account", "AssetKind", "AssetValue", "Transaction", "TransactionPart", "TransactionItem"}
+
+func load_tags(q Querier, obj_type, id string) (map[string]bool, error) {
+	tags := make(map[string]bool)
+	rows, err := q.Query("SELECT `Tag` FROM `Tags` WHERE `ObjectType` = ? AND `ObjectId` = ?", obj_type, id)
+	if err != nil {
+		return tags, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		tag := ""
+		err := rows.Scan(&tag)
+		if err != nil {
+			return tags, err
+		}
+		tags[tag] = true
+	}
+	return tags, nil
+}
+
+// Replaces all tags of the object
+func save_tags(q Querier, obj_type, id string, tags map[string]bool) error {
+	err := del_tags(q, obj_type, id)
+	if err != nil {
+		return err
+	}
+	for tag, set := range tags {
+		if !set {
+			continue
+		}
+		_, err = q.Exec("INSERT INTO `Tags` (`ObjectType`, `ObjectId`, `Tag`) VALUES (?, ?, ?)", obj_type, id, tag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func del_tags(q Querier, obj_type, id string) error {
+	_, err := q.Exec("DELETE FROM `Tags` WHERE `ObjectType` = ? AND `ObjectId` = ?", obj_type, id)
+	return err
+}
+
+func tags_list(tags map[string]bool) []string {
+	ans := make([]string, 0, len(tags))
+	for tag, set := range tags {
+		if set {
+			ans = append(ans, tag)
+		}
+	}
+	sort.Strings(ans)
+	return ans
+}
+
+func tags_string(tags map[string]bool) string {
+	return strings.Join(tags_list(tags), " ")
+}
+
+// Tags may be separated by spaces and/or commas
+func parse_tags(input string) map[string]bool {
+	tags := make(map[string]bool)
+	for _, tag := range strings.FieldsFunc(input, func(r rune) bool { return r == ' ' || r == ',' }) {
+		tags[tag] = true
+	}
+	return tags
+}
+
+func ask_tags(prompt string, tags map[string]bool) map[string]bool {
+	return parse_tags(ask_user(
+		LocalLine,
+		prompt,
+		tags_string(tags),
+		CompleterTags,
+		True))
+}
+
+// Completes the tag under the cursor, so several tags can be typed in the same line
+type TagListCompleter struct{}
+
+func (tc TagListCompleter) Do(line []rune, pos int) ([][]rune, int) {
+	start := pos
+	for start > 0 && line[start-1] != ' ' && line[start-1] != ',' {
+		start--
+	}
+	prefix := string(line[start:pos])
+	ans := make([][]rune, 0)
+	for _, tag := range CompleteTagFunc(prefix) {
+		ans = append(ans, []rune(strings.TrimPrefix(tag, prefix)+" "))
+	}
+	return ans, len(line[start:pos])
+}
+
+func CompleteTagFunc(prefix string) []string {
+	tmp := strings.Split(prefix, " ")
+	spec := tmp[len(tmp)-1]
+	rows, err := DB.Query("SELECT DISTINCT `Tag` FROM `Tags` WHERE `Tag` LIKE ? || '%' ORDER BY `Tag` LIMIT 64", spec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	found := make([]string, 0)
+	defer rows.Close()
+	for rows.Next() {
+		s := ""
+		err := rows.Scan(&s)
+		if err != nil {
+			log.Fatal(err)
+		}
+		found = append(found, s)
+	}
+	return found
+}
+
+// Finds out which kind of object the id refers to, asking the user if it is ambiguous
+func tag_object_type(id string) string {
+	found := make([]string, 0)
+	for _, obj_type := range TaggableTypes {
+		if exists_in(obj_type)(id) {
+			found = append(found, obj_type)
+		}
+	}
+	switch len(found) {
+	case 0:
+		print_err(Red("No object with id: " + id))
+		return ""
+	case 1:
+		return found[0]
+	}
+	return ask_user(
+		LocalLine,
+		Sprintf(Bold(fmt.Sprintf("Type (%s): ", strings.Join(found, ", ")))),
+		found[0],
+		nil,
+		func(s string) bool {
+			for _, obj_type := range found {
+				if s == obj_type {
+					return true
+				}
+			}
+			return false
+		})
+}
+
+// Usage: tag add <object id> <tag> [tag...]
+func tag_add(line []string) {
+	if len(line) < 2 {
+		print_err(Red("Usage: tag add <object id> <tag> [tag...]"))
+		return
+	}
+	obj_type := tag_object_type(line[0])
+	if obj_type == "" {
+		return
+	}
+	for _, tag := range line[1:] {
+		_, err := DB.Exec("INSERT OR IGNORE INTO `Tags` (`ObjectType`, `ObjectId`, `Tag`) VALUES (?, ?, ?)", obj_type, line[0], tag)
+		if err != nil {
+			print_err(err.Error())
+			return
+		}
+	}
+}
+
+// Usage: tag del <object id> <tag> [tag...]
+func tag_del(line []string) {
+	if len(line) < 2 {
+		print_err(Red("Usage: tag del <object id> <tag> [tag...]"))
+		return
+	}
+	obj_type := tag_object_type(line[0])
+	if obj_type == "" {
+		return
+	}
+	for _, tag := range line[1:] {
+		_, err := DB.Exec("DELETE FROM `Tags` WHERE `ObjectType` = ? AND `ObjectId` = ? AND `Tag` = ?", obj_type, line[0], tag)
+		if err != nil {
+			print_err(err.Error())
+			return
+		}
+	}
+}
+
+// Usage: tag rename <old> <new>
+// Objects that already have the new tag simply lose the old one.
+func tag_rename(line []string) {
+	if len(line) != 2 {
+		print_err(Red("Usage: tag rename <old> <new>"))
+		return
+	}
+	err := WithTx(func(q Querier) error {
+		_, err := q.Exec("UPDATE OR IGNORE `Tags` SET `Tag` = ? WHERE `Tag` = ?", line[1], line[0])
+		if err != nil {
+			return err
+		}
+		_, err = q.Exec("DELETE FROM `Tags` WHERE `Tag` = ?", line[0])
+		if err != nil {
+			return err
+		}
+		_, err = q.Exec("UPDATE `Budget` SET `Tag` = ? WHERE `Tag` = ?", line[1], line[0])
+		return err
+	})
+	if err != nil {
+		print_err(err.Error())
+	}
+}
+
+// Usage: tag list [tag]
+// Without a tag, lists every tag and how many objects have it. Otherwise, lists the objects with that tag.
+func tag_list(line []string) {
+	if len(line) == 0 {
+		rows, err := DB.Query("SELECT `Tag`, COUNT() FROM `Tags` GROUP BY `Tag` ORDER BY `Tag`")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			tag := ""
+			n := 0
+			err := rows.Scan(&tag, &n)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("%-24s %s\n", Bold(tag), Gray(fmt.Sprintf("%d", n)))
+		}
+		return
+	}
+
+	rows, err := DB.Query("SELECT `ObjectType`, `ObjectId` FROM `Tags` WHERE `Tag` = ? ORDER BY `ObjectType`, `ObjectId`", line[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var obj_type, id string
+		err := rows.Scan(&obj_type, &id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%-16s %s\n", Gray(obj_type), id)
+	}
+}
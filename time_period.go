@@ -27,24 +27,25 @@ func (p TimePeriod) StringDay() string {
 func ParseTimePeriod(input string) (TimePeriod, error) {
 	var err, err1, err2 error
 	var start, end, date time.Time
+	input = strings.TrimSpace(input)
 
 	// Try '2006-01-02'
 	date, err = time.Parse(DAY_FMT, input)
 	if err == nil {
-		end = EndOfDay(start)
-		return TimePeriod{Start: date, End: date}, nil
+		end = EndOfDay(date)
+		return TimePeriod{Start: date, End: end}, nil
 	}
 	// Try '2006-01'
 	start, err = time.Parse(MONTH_FMT, input)
 	if err == nil {
 		end = EndOfMonth(start)
-		return TimePeriod{Start: start, End: date}, nil
+		return TimePeriod{Start: start, End: end}, nil
 	}
 	// Try '2006'
 	start, err = time.Parse(YEAR_FMT, input)
 	if err == nil {
 		end = EndOfYear(start)
-		return TimePeriod{Start: start, End: date}, nil
+		return TimePeriod{Start: start, End: end}, nil
 	}
 
 	// Try multipart
@@ -58,24 +59,65 @@ func ParseTimePeriod(input string) (TimePeriod, error) {
 	start, err1 = time.Parse(DAY_FMT, parts[0])
 	end, err2 = time.Parse(DAY_FMT, parts[1])
 	if err1 == nil && err2 == nil {
-		end = EndOfDay(start)
+		end = EndOfDay(end)
 		return TimePeriod{Start: start, End: end}, nil
 	}
 	// Try '2006-01 2006-01'
 	start, err1 = time.Parse(MONTH_FMT, parts[0])
 	end, err2 = time.Parse(MONTH_FMT, parts[1])
 	if err1 == nil && err2 == nil {
-		end = EndOfMonth(start)
+		end = EndOfMonth(end)
 		return TimePeriod{Start: start, End: end}, nil
 	}
 	// Try '2006 2006'
 	start, err1 = time.Parse(YEAR_FMT, parts[0])
 	end, err2 = time.Parse(YEAR_FMT, parts[1])
 	if err1 == nil && err2 == nil {
-		end = EndOfYear(start)
+		end = EndOfYear(end)
 		return TimePeriod{Start: start, End: end}, nil
 	}
 
 	// Everything failed
 	return TimePeriod{}, errors.New("failed to parse: " + input)
 }
+
+func (p TimePeriod) Contains(t time.Time) bool {
+	return !t.Before(p.Start) && !t.After(p.End)
+}
+
+func IsPeriodUnit(s string) bool {
+	return s == "day" || s == "week" || s == "month" || s == "year"
+}
+
+// Splits the period in consecutive buckets of the given unit (day, week, month or year).
+// Weeks start on Mondays. The first and last buckets are aligned to the unit and may extend beyond the period.
+func (p TimePeriod) Split(unit string) []TimePeriod {
+	y, m, d := p.Start.Date()
+	loc := p.Start.Location()
+	var cur time.Time
+	var next func(time.Time) time.Time
+	switch unit {
+	case "day":
+		cur = time.Date(y, m, d, 0, 0, 0, 0, loc)
+		next = func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }
+	case "week":
+		cur = time.Date(y, m, d, 0, 0, 0, 0, loc)
+		cur = cur.AddDate(0, 0, -((int(cur.Weekday()) + 6) % 7))
+		next = func(t time.Time) time.Time { return t.AddDate(0, 0, 7) }
+	case "month":
+		cur = time.Date(y, m, 1, 0, 0, 0, 0, loc)
+		next = func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }
+	case "year":
+		cur = time.Date(y, 1, 1, 0, 0, 0, 0, loc)
+		next = func(t time.Time) time.Time { return t.AddDate(1, 0, 0) }
+	default:
+		return []TimePeriod{p}
+	}
+	ans := make([]TimePeriod, 0)
+	for !cur.After(p.End) {
+		nxt := next(cur)
+		ans = append(ans, TimePeriod{Start: cur, End: nxt.Add(-time.Second)})
+		cur = nxt
+	}
+	return ans
+}
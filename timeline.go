@@ -0,0 +1,315 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/logrusorgru/aurora"
+)
+
+const PLOT_HEIGHT = 16
+
+var PlotColors = []func(interface{}) Value{Cyan, Green, Yellow, Magenta, Blue, Red}
+var PlotSVGColors = []string{"#00aaaa", "#00aa00", "#aaaa00", "#aa00aa", "#0000aa", "#aa0000"}
+
+// Money movement of a single account in a single asset
+type FlowSummary struct {
+	AccountId   string
+	AssetKindId string
+	Inflow      int
+	Outflow     int
+}
+
+func (fs FlowSummary) Net() int {
+	return fs.Inflow + fs.Outflow
+}
+
+func (fs FlowSummary) ANSIString(kinds map[string]AssetKind) string {
+	places := kinds[fs.AssetKindId].DecimalPlaces
+	in := Sprintf(Cyan(fmt_decimal_pad(fs.Inflow, places, 8)))
+	out := Sprintf(Red(fmt_decimal_pad(fs.Outflow, places, 8)))
+	net := fmt_decimal_pad(fs.Net(), places, 8)
+	if fs.Net() >= 0 {
+		net = Sprintf(Bold(Cyan(net)))
+	} else {
+		net = Sprintf(Bold(Red(net)))
+	}
+	return fmt.Sprintf("%-14.14s %s %s %s %s", fs.AccountId, Bold(fmt.Sprintf("%3.3s", fs.AssetKindId)), in, out, net)
+}
+
+// Groups parts by account and asset. The result is sorted by account and then asset.
+func summarize_flows(parts []TransactionPart) []FlowSummary {
+	index := make(map[string]int)
+	ans := make([]FlowSummary, 0)
+	for _, tp := range parts {
+		key := tp.AccountId + "\x00" + tp.AssetKindId
+		i, ok := index[key]
+		if !ok {
+			i = len(ans)
+			index[key] = i
+			ans = append(ans, FlowSummary{AccountId: tp.AccountId, AssetKindId: tp.AssetKindId})
+		}
+		if tp.Value >= 0 {
+			ans[i].Inflow += tp.Value
+		} else {
+			ans[i].Outflow += tp.Value
+		}
+	}
+	sort.Slice(ans, func(i, j int) bool {
+		if ans[i].AccountId != ans[j].AccountId {
+			return ans[i].AccountId < ans[j].AccountId
+		}
+		return ans[i].AssetKindId < ans[j].AssetKindId
+	})
+	return ans
+}
+
+// Usage: timeline summary <day|week|month|year> <period>
+func timeline_summary(line []string) {
+	if len(line) < 2 || !IsPeriodUnit(line[0]) {
+		print_err(Red("Usage: timeline summary <day|week|month|year> <period>"))
+		return
+	}
+	period, err := ParseTimePeriod(strings.Join(line[1:], " "))
+	if err != nil {
+		print_err(err.Error())
+		return
+	}
+
+	kinds := load_asset_kinds()
+	parts := load_parts_in_period(period)
+	for _, bucket := range period.Split(line[0]) {
+		in_bucket := make([]TransactionPart, 0)
+		for _, tp := range parts {
+			if bucket.Contains(tp.EffectiveDate()) {
+				in_bucket = append(in_bucket, tp)
+			}
+		}
+		if len(in_bucket) == 0 {
+			continue
+		}
+		fmt.Printf("------------------------------ %s -------------------------------\n", Bold(bucket.StringDay()))
+		fmt.Printf("%-14.14s %3.3s %12s %12s %12s\n", "Account", "", "In", "Out", "Net")
+		for _, fs := range summarize_flows(in_bucket) {
+			fmt.Println(fs.ANSIString(kinds))
+		}
+	}
+}
+
+// Running balance of one account in one asset at the end of each bucket
+type PlotSeries struct {
+	AccountId string
+	Values    []int
+}
+
+// Usage: timeline plot <asset> <day|week|month|year> <period> <account> [account...] [svg <file>]
+// The period may span two words (e.g. '2017-01 2017-06'), accounts are everything that follows it.
+func timeline_plot(line []string) {
+	usage := "Usage: timeline plot <asset> <day|week|month|year> <period> <account> [account...] [svg <file>]"
+	if len(line) < 4 || !IsAssetKind(line[0]) || !IsPeriodUnit(line[1]) {
+		print_err(Red(usage))
+		return
+	}
+	ak := AssetKind{}
+	err := ak.Load(line[0])
+	if err != nil {
+		print_err(err.Error())
+		return
+	}
+	unit := line[1]
+	rest := line[2:]
+	// Optional SVG output
+	svg_file := ""
+	if len(rest) >= 2 && rest[len(rest)-2] == "svg" {
+		svg_file = rest[len(rest)-1]
+		rest = rest[:len(rest)-2]
+	}
+	// The period is either one or two words
+	period, err := ParseTimePeriod(rest[0])
+	acc_ids := rest[1:]
+	if len(rest) > 1 {
+		if tmp, err2 := ParseTimePeriod(rest[0] + " " + rest[1]); err2 == nil {
+			period, err = tmp, nil
+			acc_ids = rest[2:]
+		}
+	}
+	if err != nil {
+		print_err(err.Error())
+		return
+	}
+	if len(acc_ids) == 0 {
+		print_err(Red(usage))
+		return
+	}
+	for _, acc_id := range acc_ids {
+		if !IsAccount(acc_id) {
+			print_err(Red("No such account: " + acc_id))
+			return
+		}
+	}
+
+	// Compute running balances
+	accs := load_accounts()
+	buckets := period.Split(unit)
+	if len(buckets) == 0 {
+		print_err(Red("Empty period"))
+		return
+	}
+	series := make([]PlotSeries, len(acc_ids))
+	for i, acc_id := range acc_ids {
+		series[i] = PlotSeries{AccountId: acc_id, Values: make([]int, len(buckets))}
+	}
+	subtrees := make([]map[string]bool, len(acc_ids))
+	for i, acc_id := range acc_ids {
+		subtrees[i] = account_subtree(accs, acc_id)
+	}
+	// Parts are loaded once and walked in date order. Buckets that ended before now only count what was
+	// at least scheduled (planned parts that never happened are left out), later ones also count planned parts.
+	parts := load_parts_in_period(TimePeriod{End: period.End})
+	sort.Slice(parts, func(i, j int) bool { return parts[i].EffectiveDate().Before(parts[j].EffectiveDate()) })
+	scheduled := ScheduledFilter(time.Time{})
+	projected := ProjectedFilter(time.Time{})
+	sure := make([]int, len(series))
+	planned := make([]int, len(series))
+	now := time.Now()
+	next := 0
+	for j, bucket := range buckets {
+		for ; next < len(parts) && !parts[next].EffectiveDate().After(bucket.End); next++ {
+			tp := parts[next]
+			if tp.AssetKindId != ak.Id {
+				continue
+			}
+			for i := range series {
+				switch {
+				case !subtrees[i][tp.AccountId]:
+				case scheduled.Accepts(tp):
+					sure[i] += tp.Value
+				case projected.Accepts(tp):
+					planned[i] += tp.Value
+				}
+			}
+		}
+		for i := range series {
+			series[i].Values[j] = sure[i]
+			if bucket.End.After(now) {
+				series[i].Values[j] += planned[i]
+			}
+		}
+	}
+
+	plot_terminal(series, buckets, ak)
+	if svg_file != "" {
+		err = ioutil.WriteFile(svg_file, []byte(plot_svg(series, buckets, ak)), os.FileMode(int(0644)))
+		if err != nil {
+			print_err(err.Error())
+			return
+		}
+		fmt.Println(Bold("Plot saved to"), svg_file)
+	}
+}
+
+func plot_range(series []PlotSeries) (int, int) {
+	min, max := 0, 0
+	for _, ps := range series {
+		for _, val := range ps.Values {
+			if val < min {
+				min = val
+			}
+			if val > max {
+				max = val
+			}
+		}
+	}
+	if min == max {
+		max = min + 1
+	}
+	return min, max
+}
+
+func plot_terminal(series []PlotSeries, buckets []TimePeriod, ak AssetKind) {
+	min, max := plot_range(series)
+	step := float64(max-min) / float64(PLOT_HEIGHT-1)
+	row_of := func(val int) int {
+		return int(math.Round(float64(val-min) / step))
+	}
+	// Fill grid from the bottom (row 0) to the top
+	grid := make([][]string, PLOT_HEIGHT)
+	for r := range grid {
+		grid[r] = make([]string, len(buckets))
+		for c := range grid[r] {
+			grid[r][c] = " "
+		}
+	}
+	zero_row := row_of(0)
+	for c := range buckets {
+		grid[zero_row][c] = Sprintf(Gray("┈"))
+	}
+	for i, ps := range series {
+		color := PlotColors[i%len(PlotColors)]
+		for c, val := range ps.Values {
+			grid[row_of(val)][c] = Sprintf(color("●"))
+		}
+	}
+	// Print grid with the y axis labels
+	for r := PLOT_HEIGHT - 1; r >= 0; r-- {
+		label := fmt_decimal_pad(min+int(math.Round(float64(r)*step)), ak.DecimalPlaces, 10)
+		fmt.Printf("%s ┤%s\n", Gray(label), strings.Join(grid[r], " "))
+	}
+	// X axis
+	pad := strings.Repeat(" ", len(fmt_decimal_pad(0, ak.DecimalPlaces, 10)))
+	fmt.Printf("%s └%s\n", pad, strings.Repeat("─", 2*len(buckets)))
+	if len(buckets) > 0 {
+		fmt.Printf("%s  %s → %s\n", pad, buckets[0].Start.Format(DAY_FMT), buckets[len(buckets)-1].End.Format(DAY_FMT))
+	}
+	// Legend
+	for i, ps := range series {
+		color := PlotColors[i%len(PlotColors)]
+		last := ps.Values[len(ps.Values)-1]
+		fmt.Printf("%s %s %s %s\n", color("●"), Bold(ps.AccountId), fmt_decimal(last, ak.DecimalPlaces), Bold(ak.Id))
+	}
+}
+
+func plot_svg(series []PlotSeries, buckets []TimePeriod, ak AssetKind) string {
+	width, height, margin := 800.0, 400.0, 60.0
+	min, max := plot_range(series)
+	x_of := func(c int) float64 {
+		if len(buckets) <= 1 {
+			return margin
+		}
+		return margin + float64(c)*(width-2*margin)/float64(len(buckets)-1)
+	}
+	y_of := func(val int) float64 {
+		return height - margin - float64(val-min)*(height-2*margin)/float64(max-min)
+	}
+
+	s := ""
+	s += fmt.Sprintf("<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%.0f\" height=\"%.0f\" font-family=\"monospace\" font-size=\"12\">\n", width, height)
+	s += fmt.Sprintf("<rect width=\"%.0f\" height=\"%.0f\" fill=\"white\"/>\n", width, height)
+	// Axes and labels
+	s += fmt.Sprintf("<line x1=\"%.1f\" y1=\"%.1f\" x2=\"%.1f\" y2=\"%.1f\" stroke=\"black\"/>\n", margin, margin, margin, height-margin)
+	s += fmt.Sprintf("<line x1=\"%.1f\" y1=\"%.1f\" x2=\"%.1f\" y2=\"%.1f\" stroke=\"gray\" stroke-dasharray=\"4\"/>\n", margin, y_of(0), width-margin, y_of(0))
+	s += fmt.Sprintf("<text x=\"%.1f\" y=\"%.1f\" text-anchor=\"end\">%s</text>\n", margin-4, y_of(max), fmt_decimal(max, ak.DecimalPlaces))
+	s += fmt.Sprintf("<text x=\"%.1f\" y=\"%.1f\" text-anchor=\"end\">%s</text>\n", margin-4, y_of(min), fmt_decimal(min, ak.DecimalPlaces))
+	if len(buckets) > 0 {
+		s += fmt.Sprintf("<text x=\"%.1f\" y=\"%.1f\">%s</text>\n", x_of(0), height-margin+16, buckets[0].Start.Format(DAY_FMT))
+		s += fmt.Sprintf("<text x=\"%.1f\" y=\"%.1f\" text-anchor=\"end\">%s</text>\n", x_of(len(buckets)-1), height-margin+16, buckets[len(buckets)-1].End.Format(DAY_FMT))
+	}
+	// Series
+	for i, ps := range series {
+		color := PlotSVGColors[i%len(PlotSVGColors)]
+		points := make([]string, 0)
+		for c, val := range ps.Values {
+			points = append(points, fmt.Sprintf("%.1f,%.1f", x_of(c), y_of(val)))
+		}
+		s += fmt.Sprintf("<polyline fill=\"none\" stroke=\"%s\" stroke-width=\"2\" points=\"%s\"/>\n", color, strings.Join(points, " "))
+		s += fmt.Sprintf("<text x=\"%.1f\" y=\"%.1f\" fill=\"%s\">%s (%s)</text>\n", margin, 20+14*float64(i), color, html.EscapeString(ps.AccountId), html.EscapeString(ak.Id))
+	}
+	s += "</svg>\n"
+	return s
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"strings"
 	"time"
 
@@ -20,6 +22,12 @@ const (
 	TS_CANCELED  = "C"
 )
 
+// Account suggested for the parts that balance transactions on purpose (e.g. currency conversions)
+const EQUITY_ACCOUNT_ID = "equity"
+
+// When on, transactions can only be saved if their parts sum to zero for every asset. Stored as the 'strict' setting.
+var StrictDoubleEntry = false
+
 type Transaction struct {
 	Id          string
 	Name        string
@@ -36,12 +44,17 @@ func NewTransaction() *Transaction {
 	return &tr
 }
 
+func (tr Transaction) TypeName() string {
+	return "Transaction"
+}
+
 func (tr Transaction) MultilineString() string {
 	s := ""
 	s += fmt.Sprintf("%s %s\n", Bold("    Id:"), tr.Id)
 	s += fmt.Sprintf("%s %s\n", Bold("  Name:"), tr.Name)
 	s += fmt.Sprintf("%s %s\n", Bold("  Desc:"), tr.Desc)
 	s += fmt.Sprintf("%s %s\n", Bold("Period:"), tr.RefTimeSpan.String())
+	s += fmt.Sprintf("%s %s\n", Bold("  Tags:"), tags_string(tr.Tags))
 	s += fmt.Sprintf("------------------------------ %s -------------------------------\n", Bold("Transaction Parts"))
 	for _, tp := range tr.Parts {
 		s += tp.ANSIString() + "\n"
@@ -79,6 +92,10 @@ func (tr *Transaction) Load(id string) error {
 	if err != nil {
 		return err
 	}
+	tr.Tags, err = load_tags(DB, tr.TypeName(), tr.Id)
+	if err != nil {
+		return err
+	}
 	err = tr.load_parts()
 	if err != nil {
 		return err
@@ -135,25 +152,176 @@ func (tr *Transaction) load_items() error {
 }
 
 func (tr Transaction) Del(id string) error {
+	return WithTx(func(q Querier) error {
+		return tr.DelWith(q, id)
+	})
+}
+
+func (tr Transaction) DelWith(q Querier, id string) error {
 	tr.Init()
-	_, err := DB.Exec("DELETE FROM `Transaction` WHERE `Id` = ?", id)
+	err := check_unreconciled(q, "`TransactionId` = ?", id)
+	if err != nil {
+		return err
+	}
+	err = del_child_tags(q, id)
+	if err != nil {
+		return err
+	}
+	err = del_tags(q, tr.TypeName(), id)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec("DELETE FROM `Transaction` WHERE `Id` = ?", id)
 	if err != nil {
 		return err
 	}
-	_, err = DB.Exec("DELETE FROM `TransactionPart` WHERE `TransactionId` = ?", id)
+	_, err = q.Exec("DELETE FROM `TransactionPart` WHERE `TransactionId` = ?", id)
 	if err != nil {
 		return err
 	}
-	_, err = DB.Exec("DELETE FROM `TransactionItem` WHERE `TransactionId` = ?", id)
+	_, err = q.Exec("DELETE FROM `TransactionItem` WHERE `TransactionId` = ?", id)
 	if err != nil {
 		return err
 	}
+	// The occurrence stays so that 'recurring run' does not create the transaction again
+	_, err = q.Exec("UPDATE `RecurringOccurrence` SET `TransactionId` = '' WHERE `TransactionId` = ?", id)
+	return err
+}
+
+// Deletes the tags of every part and item of the transaction
+func del_child_tags(q Querier, id string) error {
+	_, err := q.Exec("DELETE FROM `Tags` WHERE `ObjectType` = 'TransactionPart' AND `ObjectId` IN (SELECT `Id` FROM `TransactionPart` WHERE `TransactionId` = ?)", id)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec("DELETE FROM `Tags` WHERE `ObjectType` = 'TransactionItem' AND `ObjectId` IN (SELECT `Id` FROM `TransactionItem` WHERE `TransactionId` = ?)", id)
+	return err
+}
+
+// Returns, for each asset, how much the non canceled parts sum to. Assets that sum to zero are left out.
+func (tr Transaction) Imbalance() Balance {
+	sums := make(Balance)
+	for _, tp := range tr.Parts {
+		if tp.Status != TS_CANCELED {
+			sums[tp.AssetKindId] += tp.Value
+		}
+	}
+	for asset_id, val := range sums {
+		if val == 0 {
+			delete(sums, asset_id)
+		}
+	}
+	return sums
+}
+
+// Compares the items against the parts. Returns one message per problem found.
+// For each asset, the items' TotalCost must match the parts' outflow and each item's UnitCost*Quantity must match its TotalCost.
+func (tr Transaction) ItemMismatches() []string {
+	msgs := make([]string, 0)
+	fmt_val := func(val int, asset_id string) string {
+		s, err := full_decimal_fmt(val, asset_id)
+		if err != nil {
+			return fmt.Sprintf("%d", val)
+		}
+		return s + " " + asset_id
+	}
+	// Items
+	item_totals := make(Balance)
+	for _, ti := range tr.Items {
+		item_totals[ti.AssetKindId] += ti.TotalCost
+		// UnitCost and TotalCost share the same precision, so rounding can only account for one unit of difference
+		expected := int(math.Round(float64(ti.UnitCost) * ti.Quantity))
+		diff := expected - ti.TotalCost
+		if diff > 1 || diff < -1 {
+			msgs = append(msgs, fmt.Sprintf("Item %s (%s): UnitCost*Quantity = %s but TotalCost = %s", ti.Id, ti.Name, fmt_val(expected, ti.AssetKindId), fmt_val(ti.TotalCost, ti.AssetKindId)))
+		}
+	}
+	// Parts
+	outflows := make(Balance)
+	for _, tp := range tr.Parts {
+		if tp.Status != TS_CANCELED && tp.Value < 0 {
+			outflows[tp.AssetKindId] -= tp.Value
+		}
+	}
+	for _, asset_id := range item_totals.AssetIds() {
+		if item_totals[asset_id] != outflows[asset_id] {
+			msgs = append(msgs, fmt.Sprintf("Items total %s but parts' outflow is %s", fmt_val(item_totals[asset_id], asset_id), fmt_val(outflows[asset_id], asset_id)))
+		}
+	}
+	return msgs
+}
+
+func (tr Transaction) PrintItemMismatches() {
+	msgs := tr.ItemMismatches()
+	if len(msgs) == 0 {
+		return
+	}
+	fmt.Printf("%s %s %s\n", Yellow("Transaction"), Bold(tr.Id), tr.Name)
+	for _, msg := range msgs {
+		fmt.Println(Yellow("  " + msg))
+	}
+}
+
+// In strict mode, fails if the parts of the transaction (as seen by q) do not balance.
+// Used after changing single parts, as the transaction itself is checked when saved.
+func check_transaction_balance(q Querier, tr_id string) error {
+	if !StrictDoubleEntry {
+		return nil
+	}
+	rows, err := q.Query("SELECT `AssetKindId`, `Value`, `Status` FROM `TransactionPart` WHERE `TransactionId` = ?", tr_id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	tr := Transaction{Id: tr_id}
+	for rows.Next() {
+		tp := TransactionPart{}
+		err := rows.Scan(&tp.AssetKindId, &tp.Value, &tp.Status)
+		if err != nil {
+			return err
+		}
+		tr.Parts = append(tr.Parts, tp)
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	err = tr.CheckBalance()
+	if err != nil {
+		return fmt.Errorf("Transaction %s: %s", tr_id, err.Error())
+	}
 	return nil
 }
 
+func (tr Transaction) CheckBalance() error {
+	imbalance := tr.Imbalance()
+	if len(imbalance) == 0 {
+		return nil
+	}
+	msgs := make([]string, 0)
+	for _, asset_id := range imbalance.AssetIds() {
+		val_str, err := full_decimal_fmt(imbalance[asset_id], asset_id)
+		if err != nil {
+			val_str = fmt.Sprintf("%d", imbalance[asset_id])
+		}
+		msgs = append(msgs, val_str+" "+asset_id)
+	}
+	return errors.New("Unbalanced transaction, parts sum to: " + strings.Join(msgs, ", "))
+}
+
 func (tr *Transaction) Save() error {
+	return WithTx(tr.SaveWith)
+}
+
+func (tr *Transaction) SaveWith(q Querier) error {
 	tr.Init()
-	_, err := DB.Exec("INSERT INTO `Transaction` (`Id`, `Name`, `Desc`, `RefStart`, `RefEnd`) VALUES (?, ?, ?, ?, ?)",
+	if StrictDoubleEntry {
+		err := tr.CheckBalance()
+		if err != nil {
+			return err
+		}
+	}
+	_, err := q.Exec("INSERT INTO `Transaction` (`Id`, `Name`, `Desc`, `RefStart`, `RefEnd`) VALUES (?, ?, ?, ?, ?)",
 		tr.Id,
 		tr.Name,
 		tr.Desc,
@@ -162,12 +330,27 @@ func (tr *Transaction) Save() error {
 	if err != nil {
 		return err
 	}
-	return tr.Update()
+	return tr.update_with(q)
 }
 
 func (tr *Transaction) Update() error {
+	return WithTx(tr.UpdateWith)
+}
+
+func (tr *Transaction) UpdateWith(q Querier) error {
 	tr.Init()
-	_, err := DB.Exec("UPDATE `Transaction` SET `Name` = ?, `Desc` = ?, `RefStart` = ?, `RefEnd` = ? WHERE `Id` = ?",
+	if StrictDoubleEntry {
+		err := tr.CheckBalance()
+		if err != nil {
+			return err
+		}
+	}
+	return tr.update_with(q)
+}
+
+// UpdateWith without the balance check (already done by SaveWith)
+func (tr *Transaction) update_with(q Querier) error {
+	_, err := q.Exec("UPDATE `Transaction` SET `Name` = ?, `Desc` = ?, `RefStart` = ?, `RefEnd` = ? WHERE `Id` = ?",
 		tr.Name,
 		tr.Desc,
 		tr.RefTimeSpan.Start.Unix(),
@@ -176,11 +359,15 @@ func (tr *Transaction) Update() error {
 	if err != nil {
 		return err
 	}
-	err = tr.UpdateParts()
+	err = save_tags(q, tr.TypeName(), tr.Id, tr.Tags)
+	if err != nil {
+		return err
+	}
+	err = tr.UpdatePartsWith(q)
 	if err != nil {
 		return err
 	}
-	err = tr.UpdateItems()
+	err = tr.UpdateItemsWith(q)
 	if err != nil {
 		return err
 	}
@@ -188,15 +375,23 @@ func (tr *Transaction) Update() error {
 }
 
 func (tr *Transaction) UpdateParts() error {
+	return WithTx(tr.UpdatePartsWith)
+}
+
+func (tr *Transaction) UpdatePartsWith(q Querier) error {
 	tr.Init()
-	// First, delete all
-	_, err := DB.Exec("DELETE FROM `TransactionPart` WHERE `TransactionId` = ?", tr.Id)
+	// First, delete all (tags included)
+	_, err := q.Exec("DELETE FROM `Tags` WHERE `ObjectType` = 'TransactionPart' AND `ObjectId` IN (SELECT `Id` FROM `TransactionPart` WHERE `TransactionId` = ?)", tr.Id)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec("DELETE FROM `TransactionPart` WHERE `TransactionId` = ?", tr.Id)
 	if err != nil {
 		return err
 	}
 	// Now let us add them back
 	for _, tp := range tr.Parts {
-		err = tp.Save()
+		err = tp.SaveWith(q)
 		if err != nil {
 			return err
 		}
@@ -205,15 +400,23 @@ func (tr *Transaction) UpdateParts() error {
 }
 
 func (tr *Transaction) UpdateItems() error {
+	return WithTx(tr.UpdateItemsWith)
+}
+
+func (tr *Transaction) UpdateItemsWith(q Querier) error {
 	tr.Init()
-	// First, delete all
-	_, err := DB.Exec("DELETE FROM `TransactionItem` WHERE `TransactionId` = ?", tr.Id)
+	// First, delete all (tags included)
+	_, err := q.Exec("DELETE FROM `Tags` WHERE `ObjectType` = 'TransactionItem' AND `ObjectId` IN (SELECT `Id` FROM `TransactionItem` WHERE `TransactionId` = ?)", tr.Id)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec("DELETE FROM `TransactionItem` WHERE `TransactionId` = ?", tr.Id)
 	if err != nil {
 		return err
 	}
 	// Now let us add them back
 	for _, ti := range tr.Items {
-		err = ti.Save()
+		err = ti.SaveWith(q)
 		if err != nil {
 			return err
 		}
@@ -247,18 +450,23 @@ func transaction_add(line []string) {
 			return err == nil
 		})
 
+	tr.Tags = ask_tags(Sprintf(Bold("  Tags: ")), tr.Tags)
+
 	// Parse stuff
 	tr.RefTimeSpan, err = ParseTimePeriod(period)
 	if err != nil {
-		fmt.Println(err.Error())
+		print_err(err.Error())
 		return
 	}
 
 	// Ask user for transaction items
+	// When scripted, the n-th item is added by '--addtransactionitem.n y' and its fields are given as e.g. '--name.n'
 	last_currency := ""
 	sum := 0
-	for {
-		flag := ToBool(ask_user(
+	for n := 1; ; n++ {
+		AnswerIndex = 0
+		flag := ToBool(ask_user_key(
+			fmt.Sprintf("addtransactionitem.%d", n),
 			LocalLine,
 			Sprintf(Bold("Add transaction item? [y/n] ")),
 			"",
@@ -267,6 +475,7 @@ func transaction_add(line []string) {
 		if flag != true {
 			break
 		}
+		AnswerIndex = n
 		// Ask transaction item details
 		ti := NewTransactionItem()
 		ti.TransactionId = tr.Id
@@ -306,6 +515,7 @@ func transaction_add(line []string) {
 			guess,
 			nil,
 			IsFloat)
+		ti.Tags = ask_tags(Sprintf(Bold("     Tags: ")), ti.Tags)
 		ti.SetTotalCost(tot_str)
 		ti.SetUnitCost(uni_str)
 		if sum >= 0 {
@@ -313,9 +523,11 @@ func transaction_add(line []string) {
 		}
 		tr.Items = append(tr.Items, *ti)
 	}
-	// Ask user for transaction parts
-	for {
-		flag := ToBool(ask_user(
+	// Ask user for transaction parts (scripted the same way as items: '--addtransactionpart.n y', '--accountid.n', ...)
+	for n := 1; ; n++ {
+		AnswerIndex = 0
+		flag := ToBool(ask_user_key(
+			fmt.Sprintf("addtransactionpart.%d", n),
 			LocalLine,
 			Sprintf(Bold("Add transaction part? [y/n] ")),
 			"",
@@ -324,6 +536,7 @@ func transaction_add(line []string) {
 		if flag != true {
 			break
 		}
+		AnswerIndex = n
 		// Ask transaction part details
 		tp := NewTransactionPart()
 		tp.TransactionId = tr.Id
@@ -371,30 +584,71 @@ func transaction_add(line []string) {
 				tp := NewTransactionPart()
 				return tp.SetStatus(s) == nil
 			})
+		tp.Memo = ask_user(
+			LocalLine,
+			Sprintf(Bold("         Memo: ")),
+			"",
+			nil,
+			True)
+		tp.Tags = ask_tags(Sprintf(Bold("         Tags: ")), tp.Tags)
 		tp.SetValue(val_str)
 		tp.SetDates(schdul, actual)
 		tp.SetStatus(status)
 		tr.Parts = append(tr.Parts, *tp)
 	}
+	AnswerIndex = 0
+	// Offer to balance the transaction
+	imbalance := tr.Imbalance()
+	if len(imbalance) > 0 && len(tr.Parts) > 0 {
+		fmt.Println(Yellow(tr.CheckBalance().Error()))
+		flag := ToBool(ask_user(
+			LocalLine,
+			Sprintf(Bold("Add balancing part(s)? [y/n] ")),
+			"",
+			nil,
+			IsBool))
+		if flag {
+			acc_id := ask_user(
+				LocalLine,
+				Sprintf(Bold("    AccountId: ")),
+				EQUITY_ACCOUNT_ID,
+				CompleterAccount,
+				IsAccount)
+			last := tr.Parts[len(tr.Parts)-1]
+			for _, asset_id := range imbalance.AssetIds() {
+				tp := NewTransactionPart()
+				tp.TransactionId = tr.Id
+				tp.AccountId = acc_id
+				tp.AssetKindId = asset_id
+				tp.Value = -imbalance[asset_id]
+				tp.Status = last.Status
+				tp.ScheduledFor = last.ScheduledFor
+				tp.ActualDate = last.ActualDate
+				tr.Parts = append(tr.Parts, *tp)
+			}
+		}
+	}
 	// Save
+	tr.PrintItemMismatches()
 	err = tr.Save()
 	if err != nil {
-		fmt.Println(err.Error())
+		print_err(err.Error())
 		return
 	}
+	fmt.Println(Bold("Id:"), tr.Id)
 }
 
 func transaction_edit(line []string) {
 	var err error
 	if len(line) == 0 {
-		fmt.Println(Red("No id specified"))
+		print_err(Red("No id specified"))
 		return
 	}
 	// Load transaction
 	tr := NewTransaction()
 	err = tr.Load(line[len(line)-1])
 	if err != nil {
-		fmt.Println(err.Error())
+		print_err(err.Error())
 		return
 	}
 	// Ask user for basic info
@@ -420,33 +674,41 @@ func transaction_edit(line []string) {
 			return err == nil
 		})
 
+	tr.Tags = ask_tags(Sprintf(Bold("  Tags: ")), tr.Tags)
+
 	// Parse stuff
 	tr.RefTimeSpan, err = ParseTimePeriod(period)
 	if err != nil {
-		fmt.Println(err.Error())
+		print_err(err.Error())
 		return
 	}
 	// Save
+	tr.PrintItemMismatches()
 	err = tr.Update()
 	if err != nil {
-		fmt.Println(err.Error())
+		print_err(err.Error())
 		return
 	}
 }
 func transaction_show(line []string) {
+	line, expr, err := parse_tag_filter(line)
+	if err != nil {
+		print_err(Red(err.Error()))
+		return
+	}
 	spec := ""
 	if len(line) > 0 {
 		spec = line[0]
 	}
 
 	tr := NewTransaction()
-	err := tr.Load(spec)
+	err = tr.Load(spec)
 	if err == nil {
 		fmt.Printf(tr.MultilineString())
 		return
 	}
 
-	rows, err := DB.Query("SELECT `Id`, `Name`, `RefStart`, `RefEnd` FROM `Transaction` WHERE `Name` LIKE '%%"+spec+"%%' OR ? = '' LIMIT 64", spec)
+	rows, err := DB.Query("SELECT `Id`, `Name`, `RefStart`, `RefEnd` FROM `Transaction` WHERE `Name` LIKE '%%"+spec+"%%' OR ? = ''"+show_limit(expr), spec)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -458,6 +720,9 @@ func transaction_show(line []string) {
 		if err != nil {
 			log.Fatal(err)
 		}
+		if expr != nil && !expr(effective_tags(tr.TypeName(), id, "")) {
+			continue
+		}
 		start := time.Unix(start_int, 0)
 		end := time.Unix(end_int, 0)
 		tmp_id := Sprintf(Gray(id))
@@ -468,7 +733,7 @@ func transaction_show(line []string) {
 
 func transaction_del(line []string) {
 	if len(line) == 0 {
-		fmt.Println(Red("No id specified"))
+		print_err(Red("No id specified"))
 		return
 	}
 	id := line[len(line)-1]
@@ -514,3 +779,66 @@ func CompleteTransactionStatusFunc(prefix string) []string {
 	}
 	return ret
 }
+
+// Usage: strict [on|off]
+func strict(line []string) {
+	if len(line) > 0 {
+		if !IsBool(line[0]) {
+			print_err(Red("Usage: strict [on|off]"))
+			return
+		}
+		StrictDoubleEntry = ToBool(line[0])
+		err := set_setting("strict", fmt.Sprintf("%t", StrictDoubleEntry))
+		if err != nil {
+			print_err(err.Error())
+			return
+		}
+	}
+	if StrictDoubleEntry {
+		fmt.Println(Bold("Strict double entry:"), Green("on"))
+	} else {
+		fmt.Println(Bold("Strict double entry:"), Gray("off"))
+	}
+}
+
+// Usage: transaction check-items [id]
+// Without an id, every transaction is checked.
+func transaction_check_items(line []string) {
+	ids := make([]string, 0)
+	if len(line) > 0 {
+		ids = append(ids, line[len(line)-1])
+	} else {
+		rows, err := DB.Query("SELECT `Id` FROM `Transaction`")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			id := ""
+			err := rows.Scan(&id)
+			if err != nil {
+				log.Fatal(err)
+			}
+			ids = append(ids, id)
+		}
+	}
+
+	bad := 0
+	for _, id := range ids {
+		tr := NewTransaction()
+		err := tr.Load(id)
+		if err != nil {
+			print_err(err.Error())
+			return
+		}
+		if len(tr.ItemMismatches()) > 0 {
+			bad++
+			tr.PrintItemMismatches()
+		}
+	}
+	if bad == 0 {
+		fmt.Println(Green(fmt.Sprintf("All %d transaction(s) reconcile", len(ids))))
+	} else {
+		print_err(Red(fmt.Sprintf("%d of %d transaction(s) do not reconcile", bad, len(ids))))
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"time"
 
 	. "github.com/logrusorgru/aurora"
 	"github.com/mgutz/str"
@@ -36,6 +37,10 @@ func (ti *TransactionItem) Init() {
 	}
 }
 
+func (ti TransactionItem) TypeName() string {
+	return "TransactionItem"
+}
+
 func (ti *TransactionItem) Load(id string) error {
 	ti.Init()
 	err := DB.QueryRow("SELECT `Id`, `TransactionId`, `Name`, `UnitCost`, `Quantity`, `TotalCost`, `AssetKindId` FROM `TransactionItem` WHERE `Id` = ?", id).
@@ -43,7 +48,8 @@ func (ti *TransactionItem) Load(id string) error {
 	if err != nil {
 		return err
 	}
-	return nil
+	ti.Tags, err = load_tags(DB, ti.TypeName(), ti.Id)
+	return err
 }
 
 func (ti TransactionItem) String() string {
@@ -65,6 +71,7 @@ func (ti TransactionItem) MultilineString() string {
 	s += fmt.Sprintf("%s %s\n", Bold("     UnitCost:"), ti.UnitCostToStr())
 	s += fmt.Sprintf("%s %f\n", Bold("     Quantity:"), ti.Quantity)
 	s += fmt.Sprintf("%s %s\n", Bold("    TotalCost:"), ti.TotalCostToStr())
+	s += fmt.Sprintf("%s %s\n", Bold("         Tags:"), tags_string(ti.Tags))
 	return s
 }
 
@@ -103,8 +110,12 @@ func (ti *TransactionItem) TotalCostToStr() string {
 }
 
 func (ti *TransactionItem) Save() error {
+	return ti.SaveWith(DB)
+}
+
+func (ti *TransactionItem) SaveWith(q Querier) error {
 	ti.Init()
-	_, err := DB.Exec("INSERT INTO `TransactionItem` (`Id`, `TransactionId`, `Name`, `UnitCost`, `AssetKindId`, `Quantity`, `TotalCost`) VALUES (?, ?, ?, ?, ?, ?, ?)",
+	_, err := q.Exec("INSERT INTO `TransactionItem` (`Id`, `TransactionId`, `Name`, `UnitCost`, `AssetKindId`, `Quantity`, `TotalCost`) VALUES (?, ?, ?, ?, ?, ?, ?)",
 		ti.Id,
 		ti.TransactionId,
 		ti.Name,
@@ -112,25 +123,66 @@ func (ti *TransactionItem) Save() error {
 		ti.AssetKindId,
 		ti.Quantity,
 		ti.TotalCost)
-	return err
+	if err != nil {
+		return err
+	}
+	return save_tags(q, ti.TypeName(), ti.Id, ti.Tags)
 }
 
 func (ti *TransactionItem) Update() error {
+	return ti.UpdateWith(DB)
+}
+
+func (ti *TransactionItem) UpdateWith(q Querier) error {
 	ti.Init()
-	_, err := DB.Exec("UPDATE `TransactionItem` SET `Name` = ?, `UnitCost` = ?, `AssetKindId` = ?, `Quantity` = ?, `TotalCost` = ? WHERE `Id` = ?",
+	_, err := q.Exec("UPDATE `TransactionItem` SET `Name` = ?, `UnitCost` = ?, `AssetKindId` = ?, `Quantity` = ?, `TotalCost` = ? WHERE `Id` = ?",
 		ti.Name,
 		ti.UnitCost,
 		ti.AssetKindId,
 		ti.Quantity,
 		ti.TotalCost,
 		ti.Id)
-	return err
+	if err != nil {
+		return err
+	}
+	return save_tags(q, ti.TypeName(), ti.Id, ti.Tags)
 }
 
 func (ti TransactionItem) Del(id string) error {
+	return ti.DelWith(DB, id)
+}
+
+func (ti TransactionItem) DelWith(q Querier, id string) error {
 	ti.Init()
-	_, err := DB.Exec("DELETE FROM `TransactionItem` WHERE `Id` = ?", id)
-	return err
+	_, err := q.Exec("DELETE FROM `TransactionItem` WHERE `Id` = ?", id)
+	if err != nil {
+		return err
+	}
+	return del_tags(q, ti.TypeName(), id)
+}
+
+// Loads every item whose transaction starts inside the period, along with that start date
+func load_items_in_period(period TimePeriod) ([]TransactionItem, []time.Time) {
+	query := "SELECT i.`Id`, i.`TransactionId`, i.`Name`, i.`UnitCost`, i.`Quantity`, i.`TotalCost`, i.`AssetKindId`, t.`RefStart` FROM `TransactionItem` i JOIN `Transaction` t ON t.`Id` = i.`TransactionId` WHERE t.`RefStart` BETWEEN ? AND ?"
+	rows, err := DB.Query(query, period.Start.Unix(), period.End.Unix())
+	if err != nil {
+		log.Fatal(err)
+	}
+	items := make([]TransactionItem, 0)
+	dates := make([]time.Time, 0)
+	defer rows.Close()
+	for rows.Next() {
+		var start int64
+		ti := TransactionItem{}
+		err := rows.Scan(&ti.Id, &ti.TransactionId, &ti.Name, &ti.UnitCost, &ti.Quantity, &ti.TotalCost, &ti.AssetKindId, &start)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ti.Init()
+		items = append(items, ti)
+		dates = append(dates, time.Unix(start, 0))
+	}
+	return items, dates
 }
 
 func transaction_item_add(line []string) {
@@ -174,26 +226,32 @@ func transaction_item_add(line []string) {
 		guess,
 		nil,
 		IsFloat)
+	ti.Tags = ask_tags(Sprintf(Bold("         Tags: ")), ti.Tags)
 	ti.SetTotalCost(tot_str)
 	ti.SetUnitCost(uni_str)
 	// Save
 	err = ti.Save()
 	if err != nil {
-		fmt.Println(err.Error())
+		print_err(err.Error())
+		return
+	}
+	tr := NewTransaction()
+	if tr.Load(ti.TransactionId) == nil {
+		tr.PrintItemMismatches()
 	}
 }
 
 func transaction_item_edit(line []string) {
 	var err error
 	if len(line) == 0 {
-		fmt.Println(Red("No id specified"))
+		print_err(Red("No id specified"))
 		return
 	}
 	// Load transaction part
 	ti := NewTransactionItem()
 	err = ti.Load(line[len(line)-1])
 	if err != nil {
-		fmt.Println(err.Error())
+		print_err(err.Error())
 		return
 	}
 	// Ask transaction part details
@@ -233,29 +291,40 @@ func transaction_item_edit(line []string) {
 		ti.UnitCostToStr(),
 		nil,
 		IsFloat)
+	ti.Tags = ask_tags(Sprintf(Bold("         Tags: ")), ti.Tags)
 	ti.SetTotalCost(tot_str)
 	ti.SetUnitCost(uni_str)
 	// Save
 	err = ti.Update()
 	if err != nil {
-		fmt.Println(err.Error())
+		print_err(err.Error())
+		return
+	}
+	tr := NewTransaction()
+	if tr.Load(ti.TransactionId) == nil {
+		tr.PrintItemMismatches()
 	}
 }
 
 func transaction_item_show(line []string) {
+	line, expr, err := parse_tag_filter(line)
+	if err != nil {
+		print_err(Red(err.Error()))
+		return
+	}
 	spec := ""
 	if len(line) > 0 {
 		spec = line[0]
 	}
 
 	ti := NewTransactionItem()
-	err := ti.Load(spec)
+	err = ti.Load(spec)
 	if err == nil {
 		fmt.Printf(ti.MultilineString())
 		return
 	}
 
-	rows, err := DB.Query("SELECT `Id` FROM `TransactionItem` WHERE `Name` LIKE '%%"+spec+"%%' OR ? = '' LIMIT 64", spec)
+	rows, err := DB.Query("SELECT `Id` FROM `TransactionItem` WHERE `Name` LIKE '%%"+spec+"%%' OR ? = ''"+show_limit(expr), spec)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -270,13 +339,16 @@ func transaction_item_show(line []string) {
 		if err != nil {
 			log.Fatal(err)
 		}
+		if expr != nil && !expr(effective_tags(ti.TypeName(), ti.Id, ti.TransactionId)) {
+			continue
+		}
 		fmt.Println(ti.ANSIString())
 	}
 }
 
 func transaction_item_del(line []string) {
 	if len(line) == 0 {
-		fmt.Println(Red("No id specified"))
+		print_err(Red("No id specified"))
 		return
 	}
 	id := line[len(line)-1]
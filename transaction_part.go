@@ -12,15 +12,18 @@ import (
 )
 
 type TransactionPart struct {
-	Id            string
-	TransactionId string
-	AccountId     string
-	Status        string
-	ScheduledFor  time.Time
-	ActualDate    time.Time
-	Value         int
-	AssetKindId   string
-	Tags          map[string]bool
+	Id               string
+	TransactionId    string
+	AccountId        string
+	Status           string
+	ScheduledFor     time.Time
+	ActualDate       time.Time
+	Value            int
+	AssetKindId      string
+	Memo             string // Free text, e.g. the description of a bank statement line
+	FitId            string // Id given by the bank in OFX statements, used to avoid importing a line twice
+	ReconciliationId string // Set once the part is confirmed against a bank statement, which locks it against edits
+	Tags             map[string]bool
 }
 
 func NewTransactionPart() *TransactionPart {
@@ -38,18 +41,23 @@ func (tp *TransactionPart) Init() {
 	}
 }
 
+func (tp TransactionPart) TypeName() string {
+	return "TransactionPart"
+}
+
 func (tp *TransactionPart) Load(id string) error {
 	var schdul, actual int64
 
 	tp.Init()
-	err := DB.QueryRow("SELECT `Id`, `TransactionId`, `AccountId`, `Status`, `ScheduledFor`, `ActualDate`, `Value`, `AssetKindId` FROM `TransactionPart` WHERE `Id` = ?", id).
-		Scan(&tp.Id, &tp.TransactionId, &tp.AccountId, &tp.Status, &schdul, &actual, &tp.Value, &tp.AssetKindId)
+	err := DB.QueryRow("SELECT `Id`, `TransactionId`, `AccountId`, `Status`, `ScheduledFor`, `ActualDate`, `Value`, `AssetKindId`, `Memo`, `FitId`, `ReconciliationId` FROM `TransactionPart` WHERE `Id` = ?", id).
+		Scan(&tp.Id, &tp.TransactionId, &tp.AccountId, &tp.Status, &schdul, &actual, &tp.Value, &tp.AssetKindId, &tp.Memo, &tp.FitId, &tp.ReconciliationId)
 	tp.ScheduledFor = time.Unix(schdul, 0)
 	tp.ActualDate = time.Unix(actual, 0)
 	if err != nil {
 		return err
 	}
-	return nil
+	tp.Tags, err = load_tags(DB, tp.TypeName(), tp.Id)
+	return err
 }
 
 func (tp TransactionPart) Date() string {
@@ -60,6 +68,14 @@ func (tp TransactionPart) Date() string {
 	return date
 }
 
+// Same as Date() but as a time.Time
+func (tp TransactionPart) EffectiveDate() time.Time {
+	if tp.Status == TS_FINISHED {
+		return tp.ActualDate
+	}
+	return tp.ScheduledFor
+}
+
 func (tp TransactionPart) ANSIString() string {
 	tmp_num := fmt.Sprintf("%11.11s", tp.ValueToStr())
 	tmp_id := Bold(fmt.Sprintf("%3.3s", tp.AssetKindId))
@@ -68,7 +84,7 @@ func (tp TransactionPart) ANSIString() string {
 	} else {
 		tmp_num = Sprintf(Red(tmp_num))
 	}
-	return fmt.Sprintf("%s %-14.14s %s %10s %s %s", Sprintf(Gray(tp.Id)), tp.AccountId, tp.Status, tp.Date(), tmp_num, tmp_id)
+	return fmt.Sprintf("%s %-14.14s %s %10s %s %s %s", Sprintf(Gray(tp.Id)), tp.AccountId, tp.Status, tp.Date(), tmp_num, tmp_id, tp.Memo)
 }
 
 func (tp TransactionPart) String() string {
@@ -85,6 +101,14 @@ func (tp TransactionPart) MultilineString() string {
 	s += fmt.Sprintf("%s %s\n", Bold("       Status:"), tp.Status)
 	s += fmt.Sprintf("%s %s\n", Bold(" ScheduledFor:"), tp.ScheduledFor.Format(DATE_FMT_SPACES))
 	s += fmt.Sprintf("%s %s\n", Bold("   ActualDate:"), tp.ActualDate.Format(DATE_FMT_SPACES))
+	s += fmt.Sprintf("%s %s\n", Bold("         Memo:"), tp.Memo)
+	if tp.FitId != "" {
+		s += fmt.Sprintf("%s %s\n", Bold("        FitId:"), tp.FitId)
+	}
+	if tp.ReconciliationId != "" {
+		s += fmt.Sprintf("%s %s\n", Bold("   Reconciled:"), tp.ReconciliationId)
+	}
+	s += fmt.Sprintf("%s %s\n", Bold("         Tags:"), tags_string(tp.Tags))
 	return s
 }
 
@@ -150,9 +174,74 @@ func (tp *TransactionPart) SetStatus(input string) error {
 	return nil
 }
 
+// Statuses each status may move to. Parts go planned → scheduled → on going → finished (steps may be skipped)
+// and can be canceled until they are finished. Finished and canceled parts are final.
+var StatusTransitions = map[string][]string{
+	TS_UNSET:     {TS_PLANNED, TS_SCHEDULED, TS_ON_GOING, TS_FINISHED, TS_CANCELED},
+	TS_PLANNED:   {TS_SCHEDULED, TS_ON_GOING, TS_FINISHED, TS_CANCELED},
+	TS_SCHEDULED: {TS_ON_GOING, TS_FINISHED, TS_CANCELED},
+	TS_ON_GOING:  {TS_FINISHED, TS_CANCELED},
+	TS_FINISHED:  {},
+	TS_CANCELED:  {},
+}
+
+var StatusNames = map[string]string{
+	TS_UNSET:     "unset",
+	TS_PLANNED:   "planned",
+	TS_SCHEDULED: "scheduled",
+	TS_ON_GOING:  "on going",
+	TS_FINISHED:  "finished",
+	TS_CANCELED:  "canceled",
+}
+
+func CanTransition(from, to string) bool {
+	if from == to {
+		return true
+	}
+	for _, status := range StatusTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Like SetStatus but only accepts the statuses allowed by StatusTransitions
+func (tp *TransactionPart) Transition(input string) error {
+	tmp := *tp
+	err := tmp.SetStatus(input)
+	if err != nil {
+		return err
+	}
+	if !CanTransition(tp.Status, tmp.Status) {
+		return fmt.Errorf("a %s part cannot become %s", StatusNames[tp.Status], StatusNames[tmp.Status])
+	}
+	tp.Status = tmp.Status
+	return nil
+}
+
+// Reconciled parts must not change, or the reconciled balance would no longer match the statement
+func (tp TransactionPart) CheckUnlocked() error {
+	if tp.ReconciliationId != "" {
+		return fmt.Errorf("Part %s was reconciled by %s, undo the reconciliation first", tp.Id, tp.ReconciliationId)
+	}
+	return nil
+}
+
+// Unlike SaveWith, which is also used to save whole transactions, the owning transaction must still balance in strict mode
 func (tp *TransactionPart) Save() error {
+	return WithTx(func(q Querier) error {
+		err := tp.SaveWith(q)
+		if err != nil {
+			return err
+		}
+		return check_transaction_balance(q, tp.TransactionId)
+	})
+}
+
+func (tp *TransactionPart) SaveWith(q Querier) error {
 	tp.Init()
-	_, err := DB.Exec("INSERT INTO `TransactionPart` (`Id`, `TransactionId`, `AccountId`, `Status`, `ScheduledFor`, `ActualDate`, `Value`, `AssetKindId`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+	_, err := q.Exec("INSERT INTO `TransactionPart` (`Id`, `TransactionId`, `AccountId`, `Status`, `ScheduledFor`, `ActualDate`, `Value`, `AssetKindId`, `Memo`, `FitId`, `ReconciliationId`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
 		tp.Id,
 		tp.TransactionId,
 		tp.AccountId,
@@ -160,27 +249,104 @@ func (tp *TransactionPart) Save() error {
 		tp.ScheduledFor.Unix(),
 		tp.ActualDate.Unix(),
 		tp.Value,
-		tp.AssetKindId)
-	return err
+		tp.AssetKindId,
+		tp.Memo,
+		tp.FitId,
+		tp.ReconciliationId)
+	if err != nil {
+		return err
+	}
+	return save_tags(q, tp.TypeName(), tp.Id, tp.Tags)
 }
 
+// Both the old and the new transaction must still balance in strict mode, since the part may have moved
 func (tp *TransactionPart) Update() error {
+	return WithTx(func(q Querier) error {
+		old_tr_id := ""
+		err := q.QueryRow("SELECT `TransactionId` FROM `TransactionPart` WHERE `Id` = ?", tp.Id).Scan(&old_tr_id)
+		if err != nil {
+			return err
+		}
+		err = tp.UpdateWith(q)
+		if err != nil {
+			return err
+		}
+		err = check_transaction_balance(q, old_tr_id)
+		if err != nil {
+			return err
+		}
+		return check_transaction_balance(q, tp.TransactionId)
+	})
+}
+
+func (tp *TransactionPart) UpdateWith(q Querier) error {
 	tp.Init()
-	_, err := DB.Exec("UPDATE `TransactionPart` SET `AccountId` = ?, `Status` = ?, `ScheduledFor` = ?, `ActualDate` = ?, `Value` = ?, `AssetKindId` = ? WHERE `Id` = ?",
+	_, err := q.Exec("UPDATE `TransactionPart` SET `TransactionId` = ?, `AccountId` = ?, `Status` = ?, `ScheduledFor` = ?, `ActualDate` = ?, `Value` = ?, `AssetKindId` = ?, `Memo` = ?, `FitId` = ?, `ReconciliationId` = ? WHERE `Id` = ?",
+		tp.TransactionId,
 		tp.AccountId,
 		tp.Status,
 		tp.ScheduledFor.Unix(),
 		tp.ActualDate.Unix(),
 		tp.Value,
 		tp.AssetKindId,
+		tp.Memo,
+		tp.FitId,
+		tp.ReconciliationId,
 		tp.Id)
-	return err
+	if err != nil {
+		return err
+	}
+	return save_tags(q, tp.TypeName(), tp.Id, tp.Tags)
 }
 
 func (tp TransactionPart) Del(id string) error {
+	return tp.DelWith(DB, id)
+}
+
+func (tp TransactionPart) DelWith(q Querier, id string) error {
 	tp.Init()
-	_, err := DB.Exec("DELETE FROM `TransactionPart` WHERE `Id` = ?", id)
-	return err
+	err := check_unreconciled(q, "`Id` = ?", id)
+	if err != nil {
+		return err
+	}
+	tr_id := ""
+	err = q.QueryRow("SELECT `TransactionId` FROM `TransactionPart` WHERE `Id` = ?", id).Scan(&tr_id)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec("DELETE FROM `TransactionPart` WHERE `Id` = ?", id)
+	if err != nil {
+		return err
+	}
+	err = del_tags(q, tp.TypeName(), id)
+	if err != nil {
+		return err
+	}
+	return check_transaction_balance(q, tr_id)
+}
+
+// Loads every non canceled part whose effective date (see Date()) falls inside the period
+func load_parts_in_period(period TimePeriod) []TransactionPart {
+	query := "SELECT `Id`, `TransactionId`, `AccountId`, `Status`, `ScheduledFor`, `ActualDate`, `Value`, `AssetKindId`, `Memo`, `FitId`, `ReconciliationId` FROM `TransactionPart` WHERE `Status` != ? AND (CASE WHEN `Status` = ? THEN `ActualDate` ELSE `ScheduledFor` END) BETWEEN ? AND ?"
+	rows, err := DB.Query(query, TS_CANCELED, TS_FINISHED, period.Start.Unix(), period.End.Unix())
+	if err != nil {
+		log.Fatal(err)
+	}
+	parts := make([]TransactionPart, 0)
+	defer rows.Close()
+	for rows.Next() {
+		var schdul, actual int64
+		tp := TransactionPart{}
+		err := rows.Scan(&tp.Id, &tp.TransactionId, &tp.AccountId, &tp.Status, &schdul, &actual, &tp.Value, &tp.AssetKindId, &tp.Memo, &tp.FitId, &tp.ReconciliationId)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tp.ScheduledFor = time.Unix(schdul, 0)
+		tp.ActualDate = time.Unix(actual, 0)
+		tp.Init()
+		parts = append(parts, tp)
+	}
+	return parts
 }
 
 func transaction_part_add(line []string) {
@@ -231,27 +397,39 @@ func transaction_part_add(line []string) {
 			tp := NewTransactionPart()
 			return tp.SetStatus(s) == nil
 		})
+	tp.Memo = ask_user(
+		LocalLine,
+		Sprintf(Bold("         Memo: ")),
+		tp.Memo,
+		nil,
+		True)
+	tp.Tags = ask_tags(Sprintf(Bold("         Tags: ")), tp.Tags)
 	tp.SetValue(val_str)
 	tp.SetDates(schdul, actual)
 	tp.SetStatus(status)
 	// Save
 	err = tp.Save()
 	if err != nil {
-		fmt.Println(err.Error())
+		print_err(err.Error())
 	}
 }
 
 func transaction_part_edit(line []string) {
 	var err error
 	if len(line) == 0 {
-		fmt.Println(Red("No id specified"))
+		print_err(Red("No id specified"))
 		return
 	}
 	// Load transaction part
 	tp := NewTransactionPart()
 	err = tp.Load(line[len(line)-1])
 	if err != nil {
-		fmt.Println(err.Error())
+		print_err(err.Error())
+		return
+	}
+	err = tp.CheckUnlocked()
+	if err != nil {
+		print_err(Red(err.Error()))
 		return
 	}
 	tp.TransactionId = ask_user(
@@ -293,36 +471,107 @@ func transaction_part_edit(line []string) {
 	status := ask_user(
 		LocalLine,
 		Sprintf(Bold("       Status: ")),
-		"",
+		tp.Status,
 		CompleterTransactionStatus,
 		func(s string) bool {
-			tp := NewTransactionPart()
-			return tp.SetStatus(s) == nil
+			tmp := *tp
+			err := tmp.Transition(s)
+			if err != nil && Interactive {
+				fmt.Println(Yellow(err.Error()))
+			}
+			return err == nil
 		})
+	tp.Memo = ask_user(
+		LocalLine,
+		Sprintf(Bold("         Memo: ")),
+		tp.Memo,
+		nil,
+		True)
+	tp.Tags = ask_tags(Sprintf(Bold("         Tags: ")), tp.Tags)
 	tp.SetValue(val_str)
 	tp.SetDates(schdul, actual)
-	tp.SetStatus(status)
+	tp.Transition(status)
 	// Save
 	err = tp.Update()
 	if err != nil {
-		fmt.Println(err.Error())
+		print_err(err.Error())
+	}
+}
+
+// Usage: transaction part settle <id> [date] [actual value]
+// Finishes the part on the given date (today by default), optionally fixing its value.
+func transaction_part_settle(line []string) {
+	if len(line) == 0 || len(line) > 3 {
+		print_err(Red("Usage: transaction part settle <id> [date] [actual value]"))
+		return
+	}
+	tp := NewTransactionPart()
+	err := tp.Load(line[0])
+	if err != nil {
+		print_err(err.Error())
+		return
+	}
+	err = tp.CheckUnlocked()
+	if err != nil {
+		print_err(Red(err.Error()))
+		return
+	}
+	// Settling again would overwrite the actual date and value
+	if tp.Status == TS_FINISHED {
+		print_err(Red("Part " + tp.Id + " is already finished"))
+		return
+	}
+	err = tp.Transition(TS_FINISHED)
+	if err != nil {
+		print_err(Red(err.Error()))
+		return
+	}
+	tp.ActualDate, _ = time.Parse(DAY_FMT, time.Now().Format(DAY_FMT))
+	if len(line) > 1 {
+		if !IsDay(line[1]) {
+			print_err(Red("Invalid date: " + line[1]))
+			return
+		}
+		tp.ActualDate, _ = time.Parse(DAY_FMT, line[1])
+	}
+	if len(line) > 2 {
+		if !IsFloat(line[2]) {
+			print_err(Red("Invalid value: " + line[2]))
+			return
+		}
+		err = tp.SetValue(line[2])
+		if err != nil {
+			print_err(Red(err.Error()))
+			return
+		}
+	}
+	err = tp.Update()
+	if err != nil {
+		print_err(err.Error())
+		return
 	}
+	fmt.Println(tp.ANSIString())
 }
 
 func transaction_part_show(line []string) {
+	line, expr, err := parse_tag_filter(line)
+	if err != nil {
+		print_err(Red(err.Error()))
+		return
+	}
 	spec := ""
 	if len(line) > 0 {
 		spec = line[0]
 	}
 
 	tp := NewTransactionPart()
-	err := tp.Load(spec)
+	err = tp.Load(spec)
 	if err == nil {
 		fmt.Printf(tp.MultilineString())
 		return
 	}
 
-	rows, err := DB.Query("SELECT `Id` FROM `TransactionPart` WHERE `AccountId` = ? OR `Status` = ? OR ? = '' LIMIT 64", spec, spec, spec)
+	rows, err := DB.Query("SELECT `Id` FROM `TransactionPart` WHERE `AccountId` = ? OR `Status` = ? OR ? = ''"+show_limit(expr), spec, spec, spec)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -337,13 +586,16 @@ func transaction_part_show(line []string) {
 		if err != nil {
 			log.Fatal(err)
 		}
+		if expr != nil && !expr(effective_tags(tp.TypeName(), tp.Id, tp.TransactionId)) {
+			continue
+		}
 		fmt.Println(tp.ANSIString())
 	}
 }
 
 func transaction_part_del(line []string) {
 	if len(line) == 0 {
-		fmt.Println(Red("No id specified"))
+		print_err(Red("No id specified"))
 		return
 	}
 	id := line[len(line)-1]